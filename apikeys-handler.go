@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// * apiKeyProblem maps the errors of the API key model functions to the matching problem
+func apiKeyProblem(err error, detail string) error {
+	switch {
+	case errors.Is(err, ErrAPIKeyNotFound):
+		return newProblem(fiber.StatusNotFound, err.Error())
+	case errors.Is(err, ErrAPIKeyScope):
+		return newProblem(fiber.StatusForbidden, err.Error())
+	case errors.Is(err, ErrTooManyAPIKeys):
+		return newProblem(fiber.StatusConflict, err.Error())
+	default:
+		return internalProblem(detail, err)
+	}
+}
+
+// * apiKeyOrAuthRequired is authRequired that also takes an X-API-Key or an OAuth client's token,
+// * for the routes machine clients call
+func apiKeyOrAuthRequired(c *fiber.Ctx) error {
+	plain := c.Get(apiKeyHeader)
+	if plain == "" {
+		return authenticate(c, true)
+	}
+
+	key, err := authenticateAPIKey(gormdb, plain)
+	if errors.Is(err, ErrInvalidAPIKey) {
+		return newProblem(fiber.StatusUnauthorized, err.Error())
+	}
+	if err != nil {
+		return internalProblem("could not check API key", err)
+	}
+
+	user, err := getUser(gormdb, int(key.UserID))
+	if errors.Is(err, ErrUserNotFound) {
+		return newProblem(fiber.StatusUnauthorized, ErrInvalidAPIKey.Error())
+	}
+	if err != nil {
+		return internalProblem("could not get user", err)
+	}
+	if user.DisabledAt != nil {
+		return newProblem(fiber.StatusForbidden, ErrAccountDisabled.Error())
+	}
+
+	if err := touchAPIKey(gormdb, key.ID); err != nil {
+		return internalProblem("could not record API key use", err)
+	}
+
+	c.Locals(principalKey, newAPIKeyPrincipal(key, user))
+
+	return c.Next()
+}
+
+// @Summary Create API key
+// @Description Create a named API key for machine clients, send it in the X-API-Key header to the /books endpoints.
+// @Description Scopes: books:read, books:write, at most what your role has. The key is only shown in this response.
+// @Tags api-keys
+// @Accept  json
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param Key body APIKeyDTO true "API key DTO"
+// @Success 201 {object} CreatedAPIKeyResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 409 {object} Problem "Conflict"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /me/api-keys [post]
+func CreateAPIKey(c *fiber.Ctx) error {
+	dto := new(APIKeyDTO)
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	key, plain, err := createAPIKey(gormdb, user, dto, currentPrincipal(c).MFA)
+	if err != nil {
+		return apiKeyProblem(err, "could not create API key")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(CreatedAPIKeyResponse{
+		APIKeyResponse: newAPIKeyResponse(key),
+		Key:            plain,
+	})
+}
+
+// @Summary List API keys
+// @Description The logged in user's API keys, newest first, revoked and expired ones included
+// @Tags api-keys
+// @Produce  json
+// @Security ApiKeyAuth
+// @Success 200 {array} APIKeyResponse
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /me/api-keys [get]
+func GetAPIKeys(c *fiber.Ctx) error {
+	keys, err := getAPIKeys(gormdb, currentUserID(c))
+	if err != nil {
+		return internalProblem("could not get API keys", err)
+	}
+
+	return c.JSON(newAPIKeyResponses(keys))
+}
+
+// @Summary Revoke API key
+// @Description Revoke one of the logged in user's API keys, it stops working at once
+// @Tags api-keys
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param keyID path int true "API key ID"
+// @Success 200 {object} APIKeyResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 404 {object} Problem "Not Found"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /me/api-keys/{keyID} [delete]
+func RevokeAPIKey(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, "API key id must be an integer")
+	}
+
+	key, err := revokeAPIKey(gormdb, currentUserID(c), id)
+	if err != nil {
+		return apiKeyProblem(err, "could not revoke API key")
+	}
+
+	return c.JSON(newAPIKeyResponse(key))
+}
+
+// @Summary List a user's API keys
+// @Description A user's API keys, newest first (admin only)
+// @Tags users
+// @Produce  json
+// @Security ApiKeyAuth
+// @x-required-role "admin"
+// @Param userID path int true "User ID"
+// @Success 200 {array} APIKeyResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /users/{userID}/api-keys [get]
+func GetUserAPIKeys(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, "user id must be an integer")
+	}
+
+	keys, err := getAPIKeys(gormdb, uint(id))
+	if err != nil {
+		return internalProblem("could not get API keys", err)
+	}
+
+	return c.JSON(newAPIKeyResponses(keys))
+}
+
+// @Summary Revoke a user's API key
+// @Description Revoke an API key of any user (admin only), it stops working at once
+// @Tags users
+// @Produce  json
+// @Security ApiKeyAuth
+// @x-required-role "admin"
+// @Param userID path int true "User ID"
+// @Param keyID path int true "API key ID"
+// @Success 200 {object} APIKeyResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 404 {object} Problem "Not Found"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /users/{userID}/api-keys/{keyID} [delete]
+func RevokeUserAPIKey(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, "user id must be an integer")
+	}
+	id, err := strconv.Atoi(c.Params("keyID"))
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, "API key id must be an integer")
+	}
+
+	key, err := revokeAPIKey(gormdb, uint(userID), id)
+	if err != nil {
+		return apiKeyProblem(err, "could not revoke API key")
+	}
+	recordAudit(c, AuditEvent{
+		Action:  "api_key.revoked",
+		Subject: userSubject(userID),
+		Details: map[string]interface{}{"api_key_id": key.ID, "prefix": apiKeyPrefix + key.Prefix},
+	})
+
+	return c.JSON(newAPIKeyResponse(key))
+}
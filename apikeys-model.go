@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	apiKeyPrefix       = "gk_"
+	defaultAPIKeyDays  = 90
+	maxActiveAPIKeys   = 20
+	apiKeyUsedThrottle = time.Minute // * last_used_at is written at most this often per key
+)
+
+// * APIKey lets a machine client call the API as its user, with at most the scopes given here.
+// * Keys look like gk_<prefix>_<secret>, only the sha256 of the whole key is stored, Prefix is shown to find it again.
+type APIKey struct {
+	ID         uint   `gorm:"primaryKey"`
+	UserID     uint   `gorm:"index;not null"`
+	Name       string `gorm:"not null"`
+	Prefix     string `gorm:"uniqueIndex;not null"`
+	KeyHash    string `gorm:"not null"`
+	Scopes     string `gorm:"not null"`               // * space separated
+	MFA        bool   `gorm:"not null;default:false"` // * created from an MFA login, so it satisfies the MFA policy
+	ExpiresAt  time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+	CreatedAt  time.Time
+}
+
+type APIKeyDTO struct {
+	Name          string   `json:"name" validate:"required,max=100" example:"nightly import" maxLength:"100"`
+	Scopes        []string `json:"scopes" validate:"required,min=1,dive,oneof=books:read books:write" example:"books:read"`
+	ExpiresInDays int      `json:"expires_in_days" validate:"omitempty,min=1,max=365" example:"90" minimum:"1" maximum:"365"` // * default 90
+}
+
+type APIKeyResponse struct {
+	ID         uint       `json:"id" example:"1"`
+	Name       string     `json:"name" example:"nightly import"`
+	Prefix     string     `json:"prefix" example:"gk_3f9a1c0b"`
+	Scopes     []string   `json:"scopes" example:"books:read"`
+	ExpiresAt  time.Time  `json:"expires_at" example:"2025-04-02T15:04:05Z"`
+	LastUsedAt *time.Time `json:"last_used_at" example:"2025-01-03T10:00:00Z"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty" example:"2025-01-04T10:00:00Z"`
+	CreatedAt  time.Time  `json:"created_at" example:"2025-01-02T15:04:05Z"`
+}
+
+// * CreatedAPIKeyResponse is the only response that has the key itself
+type CreatedAPIKeyResponse struct {
+	APIKeyResponse
+	Key string `json:"key" example:"gk_3f9a1c0b_Yk3xq0V8mZ..."`
+}
+
+var (
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	ErrInvalidAPIKey  = errors.New("invalid, expired or revoked API key")
+	ErrAPIKeyScope    = errors.New("your role doesn't have all of these scopes")
+	ErrTooManyAPIKeys = errors.New("too many active API keys, revoke one first")
+)
+
+func newAPIKeyResponse(key *APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     apiKeyPrefix + key.Prefix,
+		Scopes:     strings.Fields(key.Scopes),
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		RevokedAt:  key.RevokedAt,
+		CreatedAt:  key.CreatedAt,
+	}
+}
+
+func newAPIKeyResponses(keys []APIKey) []APIKeyResponse {
+	responses := make([]APIKeyResponse, 0, len(keys))
+	for i := range keys {
+		responses = append(responses, newAPIKeyResponse(&keys[i]))
+	}
+	return responses
+}
+
+// * grantedScopes is what a key may do right now, its scopes cut down to what the user's role has,
+// * so a demoted user's keys lose what the user lost
+func grantedScopes(keyScopes, role string) []string {
+	var scopes []string
+	for _, s := range strings.Fields(keyScopes) {
+		for _, allowed := range scopesForRole[role] {
+			if s == allowed {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	return scopes
+}
+
+// * createAPIKey returns the new key and its plain text, which is never stored
+func createAPIKey(db *gorm.DB, user *User, dto *APIKeyDTO, mfa bool) (*APIKey, string, error) {
+	if len(grantedScopes(strings.Join(dto.Scopes, " "), user.Role)) != len(dto.Scopes) {
+		return nil, "", ErrAPIKeyScope
+	}
+
+	var active int64
+	err := db.Model(&APIKey{}).
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", user.ID, time.Now()).
+		Count(&active).Error
+	if err != nil {
+		return nil, "", err
+	}
+	if active >= maxActiveAPIKeys {
+		return nil, "", ErrTooManyAPIKeys
+	}
+
+	prefix := make([]byte, 4)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, "", err
+	}
+	secret, _, err := newOpaqueToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	days := dto.ExpiresInDays
+	if days == 0 {
+		days = defaultAPIKeyDays
+	}
+
+	key := &APIKey{
+		UserID:    user.ID,
+		Name:      dto.Name,
+		Prefix:    hex.EncodeToString(prefix),
+		Scopes:    strings.Join(dto.Scopes, " "),
+		MFA:       mfa,
+		ExpiresAt: time.Now().Add(time.Duration(days) * 24 * time.Hour),
+	}
+	plain := apiKeyPrefix + key.Prefix + "_" + secret
+	key.KeyHash = hashToken(plain)
+
+	if err := db.Create(key).Error; err != nil {
+		return nil, "", err
+	}
+
+	return key, plain, nil
+}
+
+// * authenticateAPIKey finds the key of a gk_<prefix>_<secret> string and checks it is usable
+func authenticateAPIKey(db *gorm.DB, plain string) (*APIKey, error) {
+	rest, ok := strings.CutPrefix(plain, apiKeyPrefix)
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	prefix, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+
+	var key APIKey
+	result := db.Where("prefix = ?", prefix).First(&key)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidAPIKey
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key.KeyHash), []byte(hashToken(plain))) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	if key.RevokedAt != nil || time.Now().After(key.ExpiresAt) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	return &key, nil
+}
+
+// * touchAPIKey records a use of the key, skipping the write when it was recorded recently
+func touchAPIKey(db *gorm.DB, id uint) error {
+	now := time.Now()
+	return db.Model(&APIKey{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", id, now.Add(-apiKeyUsedThrottle)).
+		Update("last_used_at", now).Error
+}
+
+// * getAPIKeys lists a user's keys, newest first, revoked and expired ones included
+func getAPIKeys(db *gorm.DB, userID uint) ([]APIKey, error) {
+	var keys []APIKey
+	result := db.Where("user_id = ?", userID).Order("id desc").Find(&keys)
+	return keys, result.Error
+}
+
+// * revokeAPIKey revokes one of userID's keys, revoking twice is fine
+func revokeAPIKey(db *gorm.DB, userID uint, id int) (*APIKey, error) {
+	result := db.Model(&APIKey{}).
+		Where("id = ? AND user_id = ?", id, userID).
+		Update("revoked_at", gorm.Expr("COALESCE(revoked_at, ?)", time.Now()))
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	var key APIKey
+	if err := db.First(&key, id).Error; err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// * auditLockKey serializes writers of the audit log, each entry must see the hash of the one before it
+const auditLockKey = 7_302_114
+
+// * AuditEvent is a security relevant event, e.g. a login or a book change
+type AuditEvent struct {
+	Action         string                 `json:"action"`
+	ActorID        *uint                  `json:"actor_id,omitempty"`        // * who did it, nil when nobody is logged in
+	ImpersonatorID *uint                  `json:"impersonator_id,omitempty"` // * the admin behind ActorID's impersonation token
+	Subject        string                 `json:"subject,omitempty"`         // * what it was done to, e.g. "user:7"
+	IP             string                 `json:"ip,omitempty"`
+	RequestID      string                 `json:"request_id,omitempty"`
+	Details        map[string]interface{} `json:"details,omitempty"`
+	Before         map[string]interface{} `json:"before,omitempty"` // * the fields that changed, as they were
+	After          map[string]interface{} `json:"after,omitempty"`  // * the fields that changed, as they are now
+}
+
+// * AuditEntry is a row of audit_events. Rows are only ever inserted (a trigger refuses anything else) and each
+// * one carries the hash of the row before it, so editing or removing a row breaks the chain from there on.
+// * Details, Before and After keep the exact JSON that was hashed.
+type AuditEntry struct {
+	ID             uint      `gorm:"primaryKey"`
+	CreatedAt      time.Time `gorm:"index;not null"`
+	Action         string    `gorm:"index;not null"`
+	ActorID        *uint     `gorm:"index"`
+	ImpersonatorID *uint
+	Subject        string `gorm:"index"`
+	IP             string
+	RequestID      string
+	Details        string `gorm:"type:text"`
+	Before         string `gorm:"type:text"`
+	After          string `gorm:"type:text"`
+	PrevHash       string `gorm:"not null"` // * empty for the first entry
+	Hash           string `gorm:"uniqueIndex;not null"`
+}
+
+func (AuditEntry) TableName() string {
+	return "audit_events"
+}
+
+type AuditEntryResponse struct {
+	ID             uint            `json:"id" example:"42"`
+	CreatedAt      time.Time       `json:"created_at" example:"2025-01-02T15:04:05.123456Z"`
+	Action         string          `json:"action" example:"book.updated"`
+	ActorID        *uint           `json:"actor_id,omitempty" example:"7"`
+	ImpersonatorID *uint           `json:"impersonator_id,omitempty" example:"1"`
+	Subject        string          `json:"subject,omitempty" example:"book:3"`
+	IP             string          `json:"ip,omitempty" example:"203.0.113.9"`
+	RequestID      string          `json:"request_id,omitempty" example:"6f1c2a9e-5b7d-4c1e-9a3f-2d8e7b6c5a41"`
+	Details        json.RawMessage `json:"details,omitempty" swaggertype:"object"`
+	Before         json.RawMessage `json:"before,omitempty" swaggertype:"object"`
+	After          json.RawMessage `json:"after,omitempty" swaggertype:"object"`
+	PrevHash       string          `json:"prev_hash" example:"9b74c9897bac770ffc029102a200c5de..."`
+	Hash           string          `json:"hash" example:"3f79bb7b435b05321651daefd374cdc6..."`
+}
+
+// * rawJSON turns a stored JSON column back into JSON, an empty column is left out of the response
+func rawJSON(s string) json.RawMessage {
+	if s == "" {
+		return nil
+	}
+	return json.RawMessage(s)
+}
+
+func newAuditEntryResponse(entry *AuditEntry) AuditEntryResponse {
+	return AuditEntryResponse{
+		ID:             entry.ID,
+		CreatedAt:      entry.CreatedAt.UTC(),
+		Action:         entry.Action,
+		ActorID:        entry.ActorID,
+		ImpersonatorID: entry.ImpersonatorID,
+		Subject:        entry.Subject,
+		IP:             entry.IP,
+		RequestID:      entry.RequestID,
+		Details:        rawJSON(entry.Details),
+		Before:         rawJSON(entry.Before),
+		After:          rawJSON(entry.After),
+		PrevHash:       entry.PrevHash,
+		Hash:           entry.Hash,
+	}
+}
+
+func newAuditEntryResponses(entries []AuditEntry) []AuditEntryResponse {
+	responses := make([]AuditEntryResponse, 0, len(entries))
+	for i := range entries {
+		responses = append(responses, newAuditEntryResponse(&entries[i]))
+	}
+	return responses
+}
+
+type AuditEntryPage struct {
+	Items []AuditEntryResponse `json:"items"`
+	Total int64                `json:"total" example:"120"`
+	Page  int                  `json:"page" example:"1"`
+	Limit int                  `json:"limit" example:"20"`
+	Links PageLinks            `json:"links"`
+}
+
+type AuditVerifyResponse struct {
+	Valid    bool   `json:"valid" example:"false"`
+	Checked  int64  `json:"checked" example:"118"`                                    // * entries checked before the first broken one
+	BrokenID *uint  `json:"broken_id,omitempty" example:"119"`                        // * the first entry that doesn't match the chain
+	Detail   string `json:"detail,omitempty" example:"entry does not match its hash"` // * what is wrong with it
+}
+
+// * auditHashInput is what an entry's hash covers, everything but its id and the hash itself
+type auditHashInput struct {
+	CreatedAt      string `json:"created_at"`
+	Action         string `json:"action"`
+	ActorID        *uint  `json:"actor_id"`
+	ImpersonatorID *uint  `json:"impersonator_id"`
+	Subject        string `json:"subject"`
+	IP             string `json:"ip"`
+	RequestID      string `json:"request_id"`
+	Details        string `json:"details"`
+	Before         string `json:"before"`
+	After          string `json:"after"`
+	PrevHash       string `json:"prev_hash"`
+}
+
+func (entry *AuditEntry) computeHash() string {
+	input, _ := json.Marshal(auditHashInput{
+		CreatedAt:      entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+		Action:         entry.Action,
+		ActorID:        entry.ActorID,
+		ImpersonatorID: entry.ImpersonatorID,
+		Subject:        entry.Subject,
+		IP:             entry.IP,
+		RequestID:      entry.RequestID,
+		Details:        entry.Details,
+		Before:         entry.Before,
+		After:          entry.After,
+		PrevHash:       entry.PrevHash,
+	})
+	sum := sha256.Sum256(input)
+	return hex.EncodeToString(sum[:])
+}
+
+// * encodeAuditJSON is the stored form of an event's maps, empty when there is nothing to store
+func encodeAuditJSON(m map[string]interface{}) (string, error) {
+	if len(m) == 0 {
+		return "", nil
+	}
+	raw, err := json.Marshal(m)
+	return string(raw), err
+}
+
+// * appendAuditEntry adds the event at the end of the chain
+func appendAuditEntry(db *gorm.DB, event AuditEvent) (*AuditEntry, error) {
+	entry := &AuditEntry{
+		// * Postgres keeps microseconds, the hash must cover the time we read back
+		CreatedAt:      time.Now().UTC().Truncate(time.Microsecond),
+		Action:         event.Action,
+		ActorID:        event.ActorID,
+		ImpersonatorID: event.ImpersonatorID,
+		Subject:        event.Subject,
+		IP:             event.IP,
+		RequestID:      event.RequestID,
+	}
+
+	var err error
+	if entry.Details, err = encodeAuditJSON(event.Details); err != nil {
+		return nil, err
+	}
+	if entry.Before, err = encodeAuditJSON(event.Before); err != nil {
+		return nil, err
+	}
+	if entry.After, err = encodeAuditJSON(event.After); err != nil {
+		return nil, err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", auditLockKey).Error; err != nil {
+			return err
+		}
+
+		var last AuditEntry
+		result := tx.Select("hash").Order("id DESC").Limit(1).Find(&last)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		entry.PrevHash = last.Hash
+		entry.Hash = entry.computeHash()
+		return tx.Create(entry).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// * withRequest fills in who, from where and in which request
+func (event AuditEvent) withRequest(c *fiber.Ctx) AuditEvent {
+	if c == nil {
+		return event
+	}
+	if event.ActorID == nil {
+		event.ActorID = actorID(c)
+	}
+	if principal := currentPrincipal(c); principal != nil && principal.ImpersonatorID != 0 {
+		event.ImpersonatorID = &principal.ImpersonatorID
+	}
+	event.IP = c.IP()
+	event.RequestID, _ = c.Locals("requestid").(string)
+	return event
+}
+
+// * recordAuditTx appends the event in the caller's transaction, so a change can't commit without its audit entry
+func recordAuditTx(tx *gorm.DB, c *fiber.Ctx, event AuditEvent) error {
+	_, err := appendAuditEntry(tx, event.withRequest(c))
+	return err
+}
+
+// * recordAudit appends an event about something that already happened (a login, ...) to audit_events.
+// * An event that can't be stored is still logged as one JSON line, grep for "AUDIT".
+func recordAudit(c *fiber.Ctx, event AuditEvent) {
+	event = event.withRequest(c)
+
+	_, err := appendAuditEntry(gormdb, event)
+	if err == nil {
+		return
+	}
+	log.Printf("Error record audit event %s: %v", event.Action, err)
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encode audit event %s: %v", event.Action, err)
+		return
+	}
+	log.Printf("AUDIT %s", line)
+}
+
+// * auditState is a response as a flat map of its JSON fields, for auditChanges
+func auditState(v interface{}) map[string]interface{} {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var state map[string]interface{}
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil
+	}
+	return state
+}
+
+// * auditChanges keeps only the fields that differ between two states, before and after
+func auditChanges(before, after map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+	changedBefore, changedAfter := map[string]interface{}{}, map[string]interface{}{}
+	for k, v := range after {
+		if old, ok := before[k]; !ok || !reflect.DeepEqual(old, v) {
+			changedBefore[k], changedAfter[k] = before[k], v
+		}
+	}
+	for k, v := range before {
+		if _, ok := after[k]; !ok {
+			changedBefore[k], changedAfter[k] = v, nil
+		}
+	}
+	return changedBefore, changedAfter
+}
+
+func bookSubject(id uint) string {
+	return "book:" + strconv.FormatUint(uint64(id), 10)
+}
+
+// * bookChangeEvent is the audit event of a book change, with only the fields it changed.
+// * before is nil for a new book, after is nil for a deleted one.
+func bookChangeEvent(action string, before, after *Book) AuditEvent {
+	event := AuditEvent{Action: action}
+	switch {
+	case before == nil:
+		event.Subject, event.After = bookSubject(after.ID), auditState(newBookResponse(after))
+	case after == nil:
+		event.Subject, event.Before = bookSubject(before.ID), auditState(newBookResponse(before))
+	default:
+		event.Subject = bookSubject(after.ID)
+		event.Before, event.After = auditChanges(auditState(newBookResponse(before)), auditState(newBookResponse(after)))
+	}
+	return event
+}
+
+// * recordTokenRefresh records a refresh token trade, the caller isn't authenticated so the tokens name the user
+func recordTokenRefresh(c *fiber.Ctx, tokens *TokenPair, clientID string) {
+	details := map[string]interface{}{"family_id": tokens.FamilyID}
+	if clientID != "" {
+		details["client_id"] = clientID
+	}
+	recordAudit(c, AuditEvent{
+		Action:  "token.refreshed",
+		ActorID: &tokens.UserID,
+		Subject: userSubject(int(tokens.UserID)),
+		Details: details,
+	})
+}
+
+// * AuditQuery filters the audit log, zero values mean no filter
+type AuditQuery struct {
+	ActorID *uint
+	Entity  string // * a subject ("book:3") or a kind of subject ("book")
+	Action  string
+	From    *time.Time
+	To      *time.Time
+	Page    int
+	Limit   int
+}
+
+// * getAuditEntries lists entries newest first
+func getAuditEntries(db *gorm.DB, q AuditQuery) ([]AuditEntry, int64, error) {
+	var entries []AuditEntry
+	var total int64
+
+	tx := db.Model(&AuditEntry{})
+	if q.ActorID != nil {
+		tx = tx.Where("actor_id = ?", *q.ActorID)
+	}
+	if q.Entity != "" {
+		if strings.Contains(q.Entity, ":") {
+			tx = tx.Where("subject = ?", q.Entity)
+		} else {
+			tx = tx.Where("subject LIKE ?", strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q.Entity)+":%")
+		}
+	}
+	if q.Action != "" {
+		tx = tx.Where("action = ?", q.Action)
+	}
+	if q.From != nil {
+		tx = tx.Where("created_at >= ?", *q.From)
+	}
+	if q.To != nil {
+		tx = tx.Where("created_at < ?", *q.To)
+	}
+
+	if err := tx.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("count audit events: %w", err)
+	}
+
+	result := tx.Order("id DESC").Offset((q.Page - 1) * q.Limit).Limit(q.Limit).Find(&entries)
+	if result.Error != nil {
+		return nil, 0, fmt.Errorf("get audit events: %w", result.Error)
+	}
+
+	return entries, total, nil
+}
+
+var errAuditChainBroken = errors.New("audit chain broken")
+
+// * verifyAuditChain walks the whole log in id order and stops at the first entry that doesn't fit
+func verifyAuditChain(db *gorm.DB) (*AuditVerifyResponse, error) {
+	report := &AuditVerifyResponse{Valid: true}
+	prev := ""
+
+	var batch []AuditEntry
+	result := db.FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			entry := &batch[i]
+			switch {
+			case entry.PrevHash != prev:
+				report.Detail = "entry does not follow the one before it, an entry was removed or reordered"
+			case entry.computeHash() != entry.Hash:
+				report.Detail = "entry does not match its hash, it was changed"
+			default:
+				prev = entry.Hash
+				report.Checked++
+				continue
+			}
+
+			report.Valid = false
+			report.BrokenID = &entry.ID
+			return errAuditChainBroken
+		}
+		return nil
+	})
+	if result.Error != nil && !errors.Is(result.Error, errAuditChainBroken) {
+		return nil, result.Error
+	}
+
+	return report, nil
+}
+
+// * migrateAuditLog makes audit_events append-only, even for code that talks to the database directly
+func migrateAuditLog(db *gorm.DB) error {
+	statements := []string{
+		`CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_events is append-only';
+		END;
+		$$ LANGUAGE plpgsql`,
+		"DROP TRIGGER IF EXISTS audit_events_no_change ON audit_events",
+		`CREATE TRIGGER audit_events_no_change BEFORE UPDATE OR DELETE ON audit_events
+		FOR EACH ROW EXECUTE FUNCTION audit_events_append_only()`,
+		"DROP TRIGGER IF EXISTS audit_events_no_truncate ON audit_events",
+		`CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON audit_events
+		FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only()`,
+	}
+
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"html"
 	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"gorm.io/gorm"
 )
@@ -19,14 +26,84 @@ type Book struct {
 	Name        string `json:"name"`
 	Author      string `json:"author"`
 	Description string `json:"description"`
-	Price       uint `json:"price"`
+	Price       uint   `json:"price"`
+	Version     uint   `gorm:"not null;default:1" json:"version"` // * bumped on every update, used for ETag/If-Match
+	CreatedBy   *uint  `gorm:"index" json:"created_by"`           // * user id, nil for books created before we tracked it
+	UpdatedBy   *uint  `gorm:"index" json:"updated_by"`
 }
 
 type BookDTO struct {
-	Name        string `json:"name" example:"Harry Potter"`
-	Author      string `json:"author" example:"J.K. Rowling"`
-	Description string `json:"description" example:"A wizarding world book"`
-	Price       uint   `json:"price" example:"199"`
+	Name        string `json:"name" validate:"required,max=200" example:"Harry Potter" minLength:"1" maxLength:"200"`
+	Author      string `json:"author" validate:"required,max=100" example:"J.K. Rowling" minLength:"1" maxLength:"100"`
+	Description string `json:"description" validate:"max=2000" example:"A wizarding world book" maxLength:"2000"`
+	Price       *uint  `json:"price" validate:"required,lte=1000000" example:"199" minimum:"0" maximum:"1000000"` // * pointer so a missing price is an error but 0 is a valid price
+}
+
+// * normalize trims the text fields so "   " doesn't pass as a name
+func (dto *BookDTO) normalize() {
+	dto.Name = strings.TrimSpace(dto.Name)
+	dto.Author = strings.TrimSpace(dto.Author)
+	dto.Description = strings.TrimSpace(dto.Description)
+}
+
+// * toBook only copies what a client is allowed to set, ID and the timestamps stay with gorm
+func (dto *BookDTO) toBook() *Book {
+	book := &Book{
+		Name:        dto.Name,
+		Author:      dto.Author,
+		Description: dto.Description,
+	}
+	if dto.Price != nil {
+		book.Price = *dto.Price
+	}
+	return book
+}
+
+// * newBookDTO is the editable part of a book, the document PATCH requests are applied to
+func newBookDTO(book *Book) *BookDTO {
+	price := book.Price
+	return &BookDTO{
+		Name:        book.Name,
+		Author:      book.Author,
+		Description: book.Description,
+		Price:       &price,
+	}
+}
+
+type BookResponse struct {
+	ID          uint      `json:"id" example:"1"`
+	Name        string    `json:"name" example:"Harry Potter"`
+	Author      string    `json:"author" example:"J.K. Rowling"`
+	Description string    `json:"description" example:"A wizarding world book"`
+	Price       uint      `json:"price" example:"199"`
+	Version     uint      `json:"version" example:"3"`
+	CreatedBy   *uint     `json:"created_by" example:"7"`
+	UpdatedBy   *uint     `json:"updated_by" example:"7"`
+	CreatedAt   time.Time `json:"created_at" example:"2025-01-02T15:04:05Z"`
+	UpdatedAt   time.Time `json:"updated_at" example:"2025-01-02T15:04:05Z"`
+}
+
+func newBookResponse(book *Book) BookResponse {
+	return BookResponse{
+		ID:          book.ID,
+		Name:        book.Name,
+		Author:      book.Author,
+		Description: book.Description,
+		Price:       book.Price,
+		Version:     book.Version,
+		CreatedBy:   book.CreatedBy,
+		UpdatedBy:   book.UpdatedBy,
+		CreatedAt:   book.CreatedAt,
+		UpdatedAt:   book.UpdatedAt,
+	}
+}
+
+func newBookResponses(books []Book) []BookResponse {
+	responses := make([]BookResponse, 0, len(books))
+	for i := range books {
+		responses = append(responses, newBookResponse(&books[i]))
+	}
+	return responses
 }
 
 func createBook(db *gorm.DB, book *Book) error {
@@ -39,58 +116,558 @@ func createBook(db *gorm.DB, book *Book) error {
 	return nil
 }
 
-func getBook(db *gorm.DB, id int) *Book {
+var (
+	ErrBookNotFound        = errors.New("book not found")
+	ErrBookVersionMismatch = errors.New("book was modified by someone else")
+)
+
+func getBook(db *gorm.DB, id int) (*Book, error) {
 	var book Book
 	result := db.First(&book, id) // * first argument is for storing the book we find, second argument is for finding that primary key
 
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrBookNotFound
+	}
 	if result.Error != nil {
-		log.Fatalf("Error get book: %v", result.Error)
+		return nil, fmt.Errorf("get book %d: %w", id, result.Error)
 	}
 
-	return &book
+	return &book, nil
 }
 
-func getBooks(db *gorm.DB) []Book {
-	var books []Book
-	result := db.Find(&books)
+type BookPage struct {
+	Items []BookResponse `json:"items"`
+	Total int64          `json:"total" example:"42"`
+	Page  int            `json:"page,omitempty" example:"2"`
+	Limit int            `json:"limit" example:"20"`
+	Links PageLinks      `json:"links"`
+}
+
+// * bookSortColumns is the whitelist of columns a client may sort by, anything else is rejected
+var bookSortColumns = map[string]string{
+	"id":         "id",
+	"name":       "name",
+	"author":     "author",
+	"price":      "price",
+	"created_at": "created_at",
+	"updated_at": "updated_at",
+}
+
+type bookSort struct {
+	Field string
+	Desc  bool
+}
+
+func (s bookSort) String() string {
+	if s.Desc {
+		return "-" + s.Field
+	}
+	return s.Field
+}
+
+// * parseBookSort accepts "price" for ascending and "-price" for descending
+func parseBookSort(s string) (bookSort, error) {
+	if s == "" {
+		return bookSort{Field: "id"}, nil
+	}
+
+	sort := bookSort{Field: s}
+	if strings.HasPrefix(s, "-") {
+		sort = bookSort{Field: s[1:], Desc: true}
+	}
+
+	if _, ok := bookSortColumns[sort.Field]; !ok {
+		return sort, fmt.Errorf("cannot sort by %q", sort.Field)
+	}
+
+	return sort, nil
+}
+
+type BookQuery struct {
+	Page          int
+	Limit         int
+	CursorMode    bool
+	Cursor        *pageCursor // * nil on the first page of cursor mode
+	Sort          bookSort
+	Author        string
+	MinPrice      *uint
+	MaxPrice      *uint
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	UpdatedAfter  *time.Time
+	UpdatedBefore *time.Time
+}
+
+type bookList struct {
+	Books   []Book
+	Total   int64
+	HasMore bool // * cursor mode only, another row exists in the direction we walked
+}
 
+func applyBookFilters(tx *gorm.DB, q BookQuery) *gorm.DB {
+	if q.Author != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q.Author)
+		tx = tx.Where("author ILIKE ?", "%"+escaped+"%")
+	}
+	if q.MinPrice != nil {
+		tx = tx.Where("price >= ?", *q.MinPrice)
+	}
+	if q.MaxPrice != nil {
+		tx = tx.Where("price <= ?", *q.MaxPrice)
+	}
+	if q.CreatedAfter != nil {
+		tx = tx.Where("created_at >= ?", *q.CreatedAfter)
+	}
+	if q.CreatedBefore != nil {
+		tx = tx.Where("created_at < ?", *q.CreatedBefore)
+	}
+	if q.UpdatedAfter != nil {
+		tx = tx.Where("updated_at >= ?", *q.UpdatedAfter)
+	}
+	if q.UpdatedBefore != nil {
+		tx = tx.Where("updated_at < ?", *q.UpdatedBefore)
+	}
+
+	return tx
+}
+
+// * bookSortValue is the value of the sort column for a book, written into cursors
+func bookSortValue(book Book, field string) string {
+	switch field {
+	case "name":
+		return book.Name
+	case "author":
+		return book.Author
+	case "price":
+		return strconv.FormatUint(uint64(book.Price), 10)
+	case "created_at":
+		return book.CreatedAt.Format(time.RFC3339Nano)
+	case "updated_at":
+		return book.UpdatedAt.Format(time.RFC3339Nano)
+	default:
+		return strconv.FormatUint(uint64(book.ID), 10)
+	}
+}
+
+func parseBookSortValue(field, value string) (interface{}, error) {
+	switch field {
+	case "name", "author":
+		return value, nil
+	case "price", "id":
+		return strconv.ParseUint(value, 10, 64)
+	default:
+		return time.Parse(time.RFC3339Nano, value)
+	}
+}
+
+func getBooks(db *gorm.DB, q BookQuery) (*bookList, error) {
+	list := new(bookList)
+
+	if err := applyBookFilters(db.Model(&Book{}), q).Count(&list.Total).Error; err != nil {
+		return nil, fmt.Errorf("count books: %w", err)
+	}
+
+	column := bookSortColumns[q.Sort.Field]
+	tx := applyBookFilters(db, q)
+
+	if !q.CursorMode {
+		order := column
+		if q.Sort.Desc {
+			order += " desc"
+		}
+		if column != "id" {
+			order += ", id"
+		}
+
+		result := tx.Order(order).Offset((q.Page - 1) * q.Limit).Limit(q.Limit).Find(&list.Books)
+		if result.Error != nil {
+			return nil, fmt.Errorf("get books: %w", result.Error)
+		}
+		return list, nil
+	}
+
+	// * keyset pagination, walking backwards is the same query with the order flipped
+	desc := q.Sort.Desc
+	if q.Cursor != nil && q.Cursor.Prev {
+		desc = !desc
+	}
+
+	if q.Cursor != nil {
+		if q.Cursor.Sort != q.Sort.String() {
+			return nil, ErrInvalidCursor
+		}
+		value, err := parseBookSortValue(q.Sort.Field, q.Cursor.Value)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+
+		op := ">"
+		if desc {
+			op = "<"
+		}
+		tx = tx.Where(fmt.Sprintf("(%s, id) %s (?, ?)", column, op), value, q.Cursor.ID)
+	}
+
+	direction := "asc"
+	if desc {
+		direction = "desc"
+	}
+	order := fmt.Sprintf("%s %s, id %s", column, direction, direction)
+	if column == "id" {
+		order = "id " + direction
+	}
+
+	result := tx.Order(order).Limit(q.Limit + 1).Find(&list.Books)
 	if result.Error != nil {
-		log.Fatalf("Error get books: %v", result.Error)
+		return nil, fmt.Errorf("get books: %w", result.Error)
 	}
 
-	return books
+	if len(list.Books) > q.Limit {
+		list.HasMore = true
+		list.Books = list.Books[:q.Limit]
+	}
+
+	if q.Cursor != nil && q.Cursor.Prev {
+		for i, j := 0, len(list.Books)-1; i < j; i, j = i+1, j-1 {
+			list.Books[i], list.Books[j] = list.Books[j], list.Books[i]
+		}
+	}
+
+	return list, nil
 }
 
-func updateBook(db *gorm.DB, book *Book) error {	
-	result := db.Model(book).Updates(book) // * update only the selected field (from the book)
+// * checkBookVersion tells apart the two reasons a conditional write touched no rows
+func checkBookVersion(db *gorm.DB, id uint) error {
+	var book Book
+	result := db.Select("id", "version").First(&book, id)
 
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return ErrBookNotFound
+	}
 	if result.Error != nil {
 		return result.Error
 	}
 
+	return ErrBookVersionMismatch
+}
+
+// * updateBook replaces every client-editable column, zero values included, and bumps the version.
+// * version is the one the client last saw, 0 skips the check.
+func updateBook(db *gorm.DB, book *Book, version uint) error {
+	tx := db.Model(&Book{}).Where("id = ?", book.ID)
+	if version != 0 {
+		tx = tx.Where("version = ?", version)
+	}
+
+	// * a map (unlike a struct) makes Updates write zero values too, so this is a full replacement
+	result := tx.Updates(map[string]interface{}{
+		"name":        book.Name,
+		"author":      book.Author,
+		"description": book.Description,
+		"price":       book.Price,
+		"updated_by":  book.UpdatedBy,
+		"version":     gorm.Expr("version + 1"),
+	})
+
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return checkBookVersion(db, book.ID)
+	}
+
 	return nil
 }
 
-func deleteBook(db *gorm.DB, id int) error {
+func deleteBook(db *gorm.DB, id int, version uint) error {
 	var book Book
-	result := db.Delete(&book, id) // ! soft delete if we have DeletedAt gorm.DeletedAt `gorm:"index"`, but hard delete if we don't
+	tx := db
+	if version != 0 {
+		tx = tx.Where("version = ?", version)
+	}
+	result := tx.Delete(&book, id) // ! soft delete if we have DeletedAt gorm.DeletedAt `gorm:"index"`, but hard delete if we don't
 	// result := db.Unscoped().Delete(&book, id) // ! Permanet Delete even if we have DeletedAt gorm.DeletedAt `gorm:"index"`
 
 	if result.Error != nil {
 		return result.Error
 	}
+	if result.RowsAffected == 0 {
+		return checkBookVersion(db, uint(id))
+	}
 
 	return nil
 }
 
-func searchBook(db *gorm.DB, bookName string) []Book { // * slice normally is already an address
+type TrashedBookResponse struct {
+	BookResponse
+	DeletedAt time.Time `json:"deleted_at" example:"2025-01-03T10:00:00Z"`
+}
+
+type TrashPage struct {
+	Items []TrashedBookResponse `json:"items"`
+	Total int64                 `json:"total" example:"5"`
+	Page  int                   `json:"page" example:"1"`
+	Limit int                   `json:"limit" example:"20"`
+	Links PageLinks             `json:"links"`
+}
+
+func newTrashedBookResponses(books []Book) []TrashedBookResponse {
+	responses := make([]TrashedBookResponse, 0, len(books))
+	for i := range books {
+		responses = append(responses, TrashedBookResponse{
+			BookResponse: newBookResponse(&books[i]),
+			DeletedAt:    books[i].DeletedAt.Time,
+		})
+	}
+	return responses
+}
+
+// * getDeletedBooks lists the trash bin, most recently deleted first
+func getDeletedBooks(db *gorm.DB, page, limit int) ([]Book, int64, error) {
 	var books []Book
+	var total int64
 
-	result := db.Where("name = ?", bookName).Order("price desc").Find(&books) // * pass a pointer so that gorm can modify the books and fill it.
+	trash := db.Unscoped().Model(&Book{}).Where("deleted_at IS NOT NULL")
+	if err := trash.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("count deleted books: %w", err)
+	}
 
+	result := trash.Order("deleted_at desc, id").Offset((page - 1) * limit).Limit(limit).Find(&books)
 	if result.Error != nil {
-		log.Fatalf("Search book failed: %v", result.Error)
+		return nil, 0, fmt.Errorf("get deleted books: %w", result.Error)
 	}
 
-	return books
-}
\ No newline at end of file
+	return books, total, nil
+}
+
+// * restoreBook takes a book out of the trash, it counts as a write so the version moves on
+func restoreBook(db *gorm.DB, id int, restoredBy *uint) error {
+	result := db.Unscoped().Model(&Book{}).
+		Where("id = ? AND deleted_at IS NOT NULL", id).
+		Updates(map[string]interface{}{
+			"deleted_at": nil,
+			"updated_by": restoredBy,
+			"version":    gorm.Expr("version + 1"),
+		})
+
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrBookNotFound
+	}
+
+	return nil
+}
+
+// * purgeBook removes a book for good, whether it is in the trash or not
+func purgeBook(db *gorm.DB, id int, version uint) error {
+	tx := db.Unscoped()
+	if version != 0 {
+		tx = tx.Where("version = ?", version)
+	}
+
+	result := tx.Delete(&Book{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return checkBookVersion(db.Unscoped(), uint(id))
+	}
+
+	return nil
+}
+
+// * purgeDeletedBooks permanently removes books that have been in the trash since before the cutoff
+func purgeDeletedBooks(db *gorm.DB, cutoff time.Time) (int64, error) {
+	result := db.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff).Delete(&Book{})
+	return result.RowsAffected, result.Error
+}
+
+// * startTrashPurger empties old trash every interval until the process exits
+func startTrashPurger(db *gorm.DB, retention, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			purged, err := purgeDeletedBooks(db, time.Now().Add(-retention))
+			if err != nil {
+				log.Printf("Error purge trash: %v", err)
+			} else if purged > 0 {
+				log.Printf("Purged %d books deleted more than %s ago", purged, retention)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// * bookSearchVectorSQL is the generated tsvector column, name weighs more than author which weighs more than description
+const bookSearchVectorSQL = `ALTER TABLE books ADD COLUMN IF NOT EXISTS search_vector tsvector
+	GENERATED ALWAYS AS (
+		setweight(to_tsvector('english', coalesce(name, '')), 'A') ||
+		setweight(to_tsvector('english', coalesce(author, '')), 'B') ||
+		setweight(to_tsvector('english', coalesce(description, '')), 'C')
+	) STORED`
+
+// * migrateBookSearch adds the full-text search column and its GIN index, AutoMigrate can't express either
+func migrateBookSearch(db *gorm.DB) error {
+	if err := db.Exec(bookSearchVectorSQL).Error; err != nil {
+		return err
+	}
+
+	return db.Exec("CREATE INDEX IF NOT EXISTS idx_books_search_vector ON books USING GIN (search_vector)").Error
+}
+
+// * bookSearchRow is what the search query scans into, BookSearchResult is what goes on the wire
+type bookSearchRow struct {
+	Book
+	Rank               float64
+	NameHighlight      string
+	AuthorHighlight    string
+	DescriptionSnippet string
+}
+
+// * BookSearchResult is a book with its rank, the highlight and snippet are HTML with the book text escaped
+type BookSearchResult struct {
+	BookResponse
+	Rank               float64 `json:"rank" example:"0.42"`
+	NameHighlight      string  `json:"name_highlight" example:"<mark>Harry</mark> Potter"`
+	AuthorHighlight    string  `json:"author_highlight" example:"J.K. Rowling"`
+	DescriptionSnippet string  `json:"description_snippet" example:"A <mark>wizarding</mark> world book"`
+}
+
+type BookSearchPage struct {
+	Items []BookSearchResult `json:"items"`
+	Total int64              `json:"total" example:"3"`
+	Page  int                `json:"page" example:"1"`
+	Limit int                `json:"limit" example:"20"`
+	Links PageLinks          `json:"links"`
+}
+
+var ErrEmptySearch = errors.New("search query has no searchable terms")
+
+// * tsLexemes splits a word on anything that isn't a letter or digit, so user input can never break to_tsquery syntax
+func tsLexemes(word string) []string {
+	return strings.FieldsFunc(word, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// * buildTSQuery turns a search box string into a to_tsquery expression:
+// *   harry potter   -> harry & potter
+// *   "half blood"   -> half <-> blood (phrase)
+// *   wiz*           -> wiz:* (prefix)
+// *   -dragon        -> !dragon
+func buildTSQuery(input string) string {
+	var terms []string
+
+	for len(input) > 0 {
+		input = strings.TrimLeftFunc(input, unicode.IsSpace)
+		if input == "" {
+			break
+		}
+
+		negate := false
+		if input[0] == '-' {
+			negate = true
+			input = input[1:]
+		}
+
+		var term string
+		if strings.HasPrefix(input, `"`) {
+			end := strings.Index(input[1:], `"`)
+			phrase := input[1:]
+			if end >= 0 {
+				phrase, input = input[1:end+1], input[end+2:]
+			} else {
+				input = ""
+			}
+			term = strings.Join(tsLexemes(phrase), " <-> ")
+		} else {
+			word := input
+			if end := strings.IndexFunc(input, unicode.IsSpace); end >= 0 {
+				word, input = input[:end], input[end:]
+			} else {
+				input = ""
+			}
+
+			lexemes := tsLexemes(word)
+			if len(lexemes) > 0 && strings.HasSuffix(word, "*") {
+				lexemes[len(lexemes)-1] += ":*"
+			}
+			term = strings.Join(lexemes, " <-> ")
+		}
+
+		if term == "" {
+			continue
+		}
+		if strings.Contains(term, " ") {
+			term = "(" + term + ")"
+		}
+		if negate {
+			term = "!" + term
+		}
+		terms = append(terms, term)
+	}
+
+	return strings.Join(terms, " & ")
+}
+
+const bookSearchHighlight = "StartSel=<mark>, StopSel=</mark>, HighlightAll=true"
+const bookSearchSnippet = "StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=20, MinWords=5"
+
+// * markTags brings back the <mark> tags after escaping, they are the only HTML in a highlight
+var markTags = strings.NewReplacer("&lt;mark&gt;", "<mark>", "&lt;/mark&gt;", "</mark>")
+
+// * safeHighlight escapes the book text ts_headline returned, so a highlight is safe to render as HTML
+func safeHighlight(headline string) string {
+	return markTags.Replace(html.EscapeString(headline))
+}
+
+// * newBookSearchResults turns the search rows into the response items, in the order they were ranked
+func newBookSearchResults(rows []bookSearchRow) []BookSearchResult {
+	results := make([]BookSearchResult, 0, len(rows))
+	for i := range rows {
+		results = append(results, BookSearchResult{
+			BookResponse:       newBookResponse(&rows[i].Book),
+			Rank:               rows[i].Rank,
+			NameHighlight:      safeHighlight(rows[i].NameHighlight),
+			AuthorHighlight:    safeHighlight(rows[i].AuthorHighlight),
+			DescriptionSnippet: safeHighlight(rows[i].DescriptionSnippet),
+		})
+	}
+	return results
+}
+
+// * searchBook runs a full-text search over name, author and description, best matches first
+func searchBook(db *gorm.DB, input string, page, limit int) ([]bookSearchRow, int64, error) {
+	tsQuery := buildTSQuery(input)
+	if tsQuery == "" {
+		return nil, 0, ErrEmptySearch
+	}
+
+	var total int64
+	result := db.Raw(`SELECT count(*) FROM books
+		WHERE deleted_at IS NULL AND search_vector @@ to_tsquery('english', ?)`, tsQuery).Scan(&total)
+	if result.Error != nil {
+		return nil, 0, fmt.Errorf("count search results: %w", result.Error)
+	}
+
+	var books []bookSearchRow
+	result = db.Raw(`SELECT books.*,
+			ts_rank_cd(search_vector, query, 32) AS rank,
+			ts_headline('english', coalesce(name, ''), query, ?) AS name_highlight,
+			ts_headline('english', coalesce(author, ''), query, ?) AS author_highlight,
+			ts_headline('english', coalesce(description, ''), query, ?) AS description_snippet
+		FROM books, to_tsquery('english', ?) AS query
+		WHERE books.deleted_at IS NULL AND search_vector @@ query
+		ORDER BY rank DESC, books.id
+		LIMIT ? OFFSET ?`,
+		bookSearchHighlight, bookSearchHighlight, bookSearchSnippet, tsQuery, limit, (page-1)*limit).Scan(&books)
+	if result.Error != nil {
+		return nil, 0, fmt.Errorf("search books: %w", result.Error)
+	}
+
+	return books, total, nil
+}
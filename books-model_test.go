@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestSafeHighlightEscapesBookText(t *testing.T) {
+	tests := map[string]string{
+		"<mark>Harry</mark> Potter":                          "<mark>Harry</mark> Potter",
+		`<img src=x onerror="alert(1)"> <mark>wizard</mark>`: "&lt;img src=x onerror=&#34;alert(1)&#34;&gt; <mark>wizard</mark>",
+		"Tom & <mark>Jerry</mark>'s <script>":                "Tom &amp; <mark>Jerry</mark>&#39;s &lt;script&gt;",
+	}
+	for headline, want := range tests {
+		if got := safeHighlight(headline); got != want {
+			t.Errorf("safeHighlight(%q) = %q, want %q", headline, got, want)
+		}
+	}
+}
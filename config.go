@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm/logger"
+)
+
+// * Config is every setting of the server. Each source overrides the ones before it: the defaults, the config file
+// * (YAML or TOML, keys as in the yaml tags), .env, environment variables (env tags) and flags (-database.host=...).
+// * Fields tagged secret are redacted when the config is printed.
+type Config struct {
+	ListenAddr     string        `yaml:"listen_addr" toml:"listen_addr" env:"LISTEN_ADDR"`
+	PublicURL      string        `yaml:"public_url" toml:"public_url" env:"PUBLIC_URL"` // * where clients reach this API, used for links in emails
+	LogLevel       string        `yaml:"log_level" toml:"log_level" env:"LOG_LEVEL"`    // * of the SQL log: silent, error, warn or info
+	AdminEmail     string        `yaml:"admin_email" toml:"admin_email" env:"ADMIN_EMAIL"`
+	TrashRetention time.Duration `yaml:"trash_retention" toml:"trash_retention" env:"TRASH_RETENTION"`
+
+	Database DatabaseConfig `yaml:"database" toml:"database"`
+	JWT      JWTConfig      `yaml:"jwt" toml:"jwt"`
+	Session  SessionConfig  `yaml:"session" toml:"session"`
+	Mail     MailConfig     `yaml:"mail" toml:"mail"`
+	OIDC     OIDCConfig     `yaml:"oidc" toml:"oidc"`
+}
+
+type DatabaseConfig struct {
+	Host     string `yaml:"host" toml:"host" env:"POSTGRES_HOST"`
+	Port     int    `yaml:"port" toml:"port" env:"POSTGRES_PORT"`
+	Name     string `yaml:"name" toml:"name" env:"POSTGRES_DB"`
+	User     string `yaml:"user" toml:"user" env:"POSTGRES_USER"`
+	Password string `yaml:"password" toml:"password" env:"POSTGRES_PASSWORD" secret:"true"`
+	SSLMode  string `yaml:"sslmode" toml:"sslmode" env:"POSTGRES_SSLMODE"`
+}
+
+type JWTConfig struct {
+	SecretKey       string        `yaml:"secret_key" toml:"secret_key" env:"JWT_SECRET_KEY" secret:"true"` // * HS256, only without KeysDir
+	KeysDir         string        `yaml:"keys_dir" toml:"keys_dir" env:"JWT_KEYS_DIR"`
+	SigningKid      string        `yaml:"signing_kid" toml:"signing_kid" env:"JWT_SIGNING_KID"`
+	Issuer          string        `yaml:"issuer" toml:"issuer" env:"JWT_ISSUER"`
+	Audience        string        `yaml:"audience" toml:"audience" env:"JWT_AUDIENCE"`
+	AccessTokenTTL  time.Duration `yaml:"access_token_ttl" toml:"access_token_ttl" env:"ACCESS_TOKEN_TTL"`
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl" toml:"refresh_token_ttl" env:"REFRESH_TOKEN_TTL"`
+}
+
+type SessionConfig struct {
+	IdleTimeout     time.Duration `yaml:"idle_timeout" toml:"idle_timeout" env:"SESSION_IDLE_TIMEOUT"`
+	AbsoluteTimeout time.Duration `yaml:"absolute_timeout" toml:"absolute_timeout" env:"SESSION_ABSOLUTE_TIMEOUT"`
+}
+
+type MailConfig struct {
+	Mailer             string        `yaml:"mailer" toml:"mailer" env:"MAILER"`
+	Dir                string        `yaml:"dir" toml:"dir" env:"MAIL_DIR"`
+	SMTPAddr           string        `yaml:"smtp_addr" toml:"smtp_addr" env:"SMTP_ADDR"`
+	SMTPUsername       string        `yaml:"smtp_username" toml:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword       string        `yaml:"smtp_password" toml:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+	From               string        `yaml:"from" toml:"from" env:"MAIL_FROM"`
+	VerificationSecret string        `yaml:"verification_secret" toml:"verification_secret" env:"EMAIL_VERIFICATION_SECRET" secret:"true"`
+	VerificationTTL    time.Duration `yaml:"verification_ttl" toml:"verification_ttl" env:"EMAIL_VERIFICATION_TTL"`
+	PasswordResetTTL   time.Duration `yaml:"password_reset_ttl" toml:"password_reset_ttl" env:"PASSWORD_RESET_TTL"`
+	PasswordResetURL   string        `yaml:"password_reset_url" toml:"password_reset_url" env:"PASSWORD_RESET_URL"`
+}
+
+type OIDCConfig struct {
+	Issuer       string   `yaml:"issuer" toml:"issuer" env:"OIDC_ISSUER"` // * empty turns single sign-on off
+	ClientID     string   `yaml:"client_id" toml:"client_id" env:"OIDC_CLIENT_ID"`
+	ClientSecret string   `yaml:"client_secret" toml:"client_secret" env:"OIDC_CLIENT_SECRET" secret:"true"`
+	RedirectURL  string   `yaml:"redirect_url" toml:"redirect_url" env:"OIDC_REDIRECT_URL"` // * defaults to PUBLIC_URL/auth/oidc/callback
+	Scopes       []string `yaml:"scopes" toml:"scopes" env:"OIDC_SCOPES"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr:     ":8080",
+		PublicURL:      "http://localhost:8080",
+		LogLevel:       "info",
+		TrashRetention: 30 * 24 * time.Hour,
+		Database: DatabaseConfig{
+			Host:    "localhost",
+			Port:    5432,
+			SSLMode: "disable",
+		},
+		JWT: JWTConfig{
+			Issuer:          "go-gorm",
+			Audience:        "book-api",
+			AccessTokenTTL:  15 * time.Minute,
+			RefreshTokenTTL: 30 * 24 * time.Hour,
+		},
+		Session: SessionConfig{
+			IdleTimeout:     30 * time.Minute,
+			AbsoluteTimeout: 12 * time.Hour,
+		},
+		Mail: MailConfig{
+			Mailer:           "log",
+			Dir:              "./mail",
+			From:             "Book API <no-reply@localhost>",
+			VerificationTTL:  24 * time.Hour,
+			PasswordResetTTL: time.Hour,
+		},
+		OIDC: OIDCConfig{
+			Scopes: []string{"openid", "email", "profile"},
+		},
+	}
+}
+
+// * configField is one setting, found by walking Config's tags
+type configField struct {
+	key    string // * dotted path in the config file, also the name of its flag
+	env    string
+	secret bool
+	value  reflect.Value
+}
+
+func (cfg *Config) fields() []configField {
+	var fields []configField
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			key := prefix + f.Tag.Get("yaml")
+			if f.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), key+".")
+				continue
+			}
+			fields = append(fields, configField{
+				key:    key,
+				env:    f.Tag.Get("env"),
+				secret: f.Tag.Get("secret") == "true",
+				value:  v.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "")
+	return fields
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// * set parses an env var or flag into the field
+func (f configField) set(s string) error {
+	v := f.value
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Slice:
+		v.Set(reflect.ValueOf(strings.Fields(strings.ReplaceAll(s, ",", " "))))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func (f configField) String() string {
+	switch {
+	case f.secret:
+		if f.value.IsZero() {
+			return ""
+		}
+		return "[redacted]"
+	case f.value.Type() == durationType:
+		return time.Duration(f.value.Int()).String()
+	case f.value.Kind() == reflect.Slice:
+		return strings.Join(f.value.Interface().([]string), " ")
+	default:
+		return fmt.Sprint(f.value.Interface())
+	}
+}
+
+// * String lists every setting, with secrets redacted, so the config can be logged at startup
+func (cfg Config) String() string {
+	var b strings.Builder
+	for _, f := range cfg.fields() {
+		fmt.Fprintf(&b, "\n  %s=%s", f.key, f)
+	}
+	return b.String()
+}
+
+// * loadConfig reads every source in order. args are the command line flags, the config file is -config or CONFIG_FILE.
+func loadConfig(args []string) (*Config, error) {
+	cfg := defaultConfig()
+
+	// * flags win over everything, so they are parsed first and applied last
+	flags := flag.NewFlagSet("book-api", flag.ContinueOnError)
+	configFile := flags.String("config", "", "config file, .yaml, .yml or .toml (CONFIG_FILE)")
+	values := map[string]*string{}
+	for _, f := range cfg.fields() {
+		values[f.key] = flags.String(f.key, "", "overrides "+f.env)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// * .env is optional, containers set real environment variables instead, and those win over it
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("load .env: %w", err)
+	}
+
+	if *configFile == "" {
+		*configFile = os.Getenv("CONFIG_FILE")
+	}
+	if *configFile != "" {
+		if err := cfg.readFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range cfg.fields() {
+		if v, ok := os.LookupEnv(f.env); ok && v != "" {
+			if err := f.set(v); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.env, err)
+			}
+		}
+	}
+
+	var err error
+	flags.Visit(func(fl *flag.Flag) {
+		if fl.Name == "config" || err != nil {
+			return
+		}
+		for _, f := range cfg.fields() {
+			if f.key == fl.Name {
+				if e := f.set(*values[f.key]); e != nil {
+					err = fmt.Errorf("-%s: %w", f.key, e)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.PublicURL = strings.TrimSuffix(cfg.PublicURL, "/")
+	if cfg.OIDC.RedirectURL == "" {
+		cfg.OIDC.RedirectURL = cfg.PublicURL + "/auth/oidc/callback"
+	}
+
+	return cfg, nil
+}
+
+// * mustApplyConfig loads the config and applies it, nothing works without one
+func mustApplyConfig(args []string) *Config {
+	cfg, err := loadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Error load config: %v", err)
+	}
+	cfg.apply()
+	return cfg
+}
+
+// * readFile decodes a YAML or TOML file over the config, keys it doesn't know are an error (most likely a typo)
+func (cfg *Config) readFile(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(raw))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(raw), cfg)
+		if err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("config file %s: unknown key %s", path, undecoded[0])
+		}
+	default:
+		return fmt.Errorf("config file %s: use .yaml, .yml or .toml", path)
+	}
+
+	return nil
+}
+
+var logLevels = map[string]logger.LogLevel{
+	"silent": logger.Silent,
+	"error":  logger.Error,
+	"warn":   logger.Warn,
+	"info":   logger.Info,
+}
+
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// * validate reports every invalid setting at once, so a broken deploy fails at startup and not on first use
+func (cfg *Config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(cfg.ListenAddr != "", "LISTEN_ADDR must not be empty")
+	u, err := url.Parse(cfg.PublicURL)
+	check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "PUBLIC_URL must be an http(s) URL")
+	_, ok := logLevels[cfg.LogLevel]
+	check(ok, "LOG_LEVEL must be one of: silent error warn info")
+	check(cfg.TrashRetention > 0, "TRASH_RETENTION must be positive")
+
+	check(cfg.Database.Host != "", "POSTGRES_HOST must not be empty")
+	check(cfg.Database.Port > 0 && cfg.Database.Port < 65536, "POSTGRES_PORT must be between 1 and 65535")
+	check(cfg.Database.Name != "", "POSTGRES_DB is required")
+	check(cfg.Database.User != "", "POSTGRES_USER is required")
+	check(contains(sslModes, cfg.Database.SSLMode), "POSTGRES_SSLMODE must be one of: %s", strings.Join(sslModes, " "))
+
+	check(cfg.JWT.KeysDir != "" || cfg.JWT.SecretKey != "", "set JWT_KEYS_DIR (RS256/EdDSA keys) or JWT_SECRET_KEY (HS256)")
+	check(cfg.JWT.Issuer != "", "JWT_ISSUER must not be empty")
+	check(cfg.JWT.Audience != "", "JWT_AUDIENCE must not be empty")
+	check(cfg.JWT.AccessTokenTTL > 0, "ACCESS_TOKEN_TTL must be positive")
+	check(cfg.JWT.RefreshTokenTTL > cfg.JWT.AccessTokenTTL, "REFRESH_TOKEN_TTL must be longer than ACCESS_TOKEN_TTL")
+
+	check(cfg.Session.IdleTimeout > 0, "SESSION_IDLE_TIMEOUT must be positive")
+	check(cfg.Session.AbsoluteTimeout >= cfg.Session.IdleTimeout, "SESSION_ABSOLUTE_TIMEOUT must not be shorter than SESSION_IDLE_TIMEOUT")
+
+	check(contains([]string{"log", "file", "smtp"}, cfg.Mail.Mailer), "MAILER must be one of: log file smtp")
+	check(cfg.Mail.Mailer != "smtp" || cfg.Mail.SMTPAddr != "", "MAILER=smtp needs SMTP_ADDR")
+	check(cfg.Mail.VerificationTTL > 0, "EMAIL_VERIFICATION_TTL must be positive")
+	check(cfg.Mail.PasswordResetTTL > 0, "PASSWORD_RESET_TTL must be positive")
+
+	if cfg.OIDC.Issuer != "" {
+		check(cfg.OIDC.ClientID != "", "OIDC_ISSUER needs OIDC_CLIENT_ID")
+		check(contains(cfg.OIDC.Scopes, "openid"), "OIDC_SCOPES must include openid")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// * dsn is a URL, so a password with spaces or quotes needs no escaping of its own
+func (db DatabaseConfig) dsn() string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(db.User, db.Password),
+		Host:     net.JoinHostPort(db.Host, strconv.Itoa(db.Port)),
+		Path:     "/" + db.Name,
+		RawQuery: url.Values{"sslmode": {db.SSLMode}}.Encode(),
+	}
+	return u.String()
+}
+
+// * apply hands the settings to the package variables the rest of the server reads
+func (cfg *Config) apply() {
+	adminEmail = cfg.AdminEmail
+	publicURL = cfg.PublicURL
+	trashRetention = cfg.TrashRetention
+
+	jwtSecretKey = cfg.JWT.SecretKey
+	jwtKeysDir = cfg.JWT.KeysDir
+	jwtSigningKid = cfg.JWT.SigningKid
+	jwtIssuer = cfg.JWT.Issuer
+	jwtAudience = cfg.JWT.Audience
+	accessTokenTTL = cfg.JWT.AccessTokenTTL
+	refreshTokenTTL = cfg.JWT.RefreshTokenTTL
+
+	sessionIdleTimeout = cfg.Session.IdleTimeout
+	sessionAbsoluteTimeout = cfg.Session.AbsoluteTimeout
+
+	mailerKind = cfg.Mail.Mailer
+	mailDir = cfg.Mail.Dir
+	smtpAddr = cfg.Mail.SMTPAddr
+	smtpUsername = cfg.Mail.SMTPUsername
+	smtpPassword = cfg.Mail.SMTPPassword
+	mailFrom = cfg.Mail.From
+	emailVerificationSecret = []byte(cfg.Mail.VerificationSecret)
+	emailVerificationTTL = cfg.Mail.VerificationTTL
+	passwordResetTTL = cfg.Mail.PasswordResetTTL
+	passwordResetURL = cfg.Mail.PasswordResetURL
+
+	oidcIssuer = cfg.OIDC.Issuer
+	oidcClientID = cfg.OIDC.ClientID
+	oidcClientSecret = cfg.OIDC.ClientSecret
+	oidcRedirectURL = cfg.OIDC.RedirectURL
+	oidcScopes = cfg.OIDC.Scopes
+}
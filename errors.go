@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const problemContentType = "application/problem+json"
+
+// * Problem is an RFC 7807 problem details body, every error response of the API uses it
+type Problem struct {
+	Type      string       `json:"type" example:"/problems/not-found"`
+	Title     string       `json:"title" example:"Not Found"`
+	Status    int          `json:"status" example:"404"`
+	Detail    string       `json:"detail,omitempty" example:"book not found"`
+	Instance  string       `json:"instance,omitempty" example:"/books/999"`
+	RequestID string       `json:"request_id,omitempty" example:"3f2c1a9e-8d7b-4c6a-9e5f-1b2d3c4e5f60"`
+	Errors    []FieldError `json:"errors,omitempty"`
+
+	cause error // * logged for server errors, never sent to the client
+}
+
+type FieldError struct {
+	Field   string `json:"field" example:"name"`
+	Message string `json:"message" example:"name is required"`
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Title + ": " + p.Detail
+	}
+	return p.Title
+}
+
+func (p *Problem) Unwrap() error {
+	return p.cause
+}
+
+// * problemType builds the type URI from the status text, e.g. 404 -> /problems/not-found
+func problemType(status int) string {
+	return "/problems/" + strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "-")
+}
+
+func newProblem(status int, detail string) *Problem {
+	return &Problem{
+		Type:   problemType(status),
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// * internalProblem hides the real error from the client, the error handler logs it instead
+func internalProblem(detail string, cause error) *Problem {
+	p := newProblem(fiber.StatusInternalServerError, detail)
+	p.cause = cause
+	return p
+}
+
+func validationProblem(errs []FieldError) *Problem {
+	p := newProblem(fiber.StatusBadRequest, "request validation failed")
+	p.Type = "/problems/validation-failed"
+	p.Errors = errs
+	return p
+}
+
+// * problemErrorHandler is the fiber ErrorHandler, it turns whatever a handler returned into problem+json
+func problemErrorHandler(c *fiber.Ctx, err error) error {
+	var p *Problem
+	var fe *fiber.Error
+
+	switch {
+	case errors.As(err, &p):
+	case errors.As(err, &fe):
+		p = newProblem(fe.Code, fe.Message)
+	default:
+		p = internalProblem("internal server error", err)
+	}
+
+	if p.Status >= fiber.StatusInternalServerError && p.cause != nil {
+		log.Printf("%s %s: %v", c.Method(), c.OriginalURL(), p.cause)
+	}
+
+	body := *p
+	body.Instance = c.OriginalURL()
+	if id, ok := c.Locals("requestid").(string); ok {
+		body.RequestID = id
+	}
+
+	return c.Status(body.Status).JSON(body, problemContentType)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// * bookETag is a strong ETag built from the row version, it changes on every successful write
+func bookETag(book *Book) string {
+	return `"` + strconv.FormatUint(uint64(book.Version), 10) + `"`
+}
+
+func splitETags(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// * notModified reports whether If-None-Match matches the current ETag, it uses the weak comparison (RFC 9110 13.1.2)
+func notModified(c *fiber.Ctx, etag string) bool {
+	header := c.Get(fiber.HeaderIfNoneMatch)
+	if header == "" {
+		return false
+	}
+
+	for _, tag := range splitETags(header) {
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// * requiredVersion reads If-Match on a write and returns the book version the client expects.
+// * Writes without If-Match get 428, "*" returns 0 meaning any existing version.
+func requiredVersion(c *fiber.Ctx) (uint, error) {
+	header := c.Get(fiber.HeaderIfMatch)
+	if header == "" {
+		return 0, newProblem(fiber.StatusPreconditionRequired, "send the book's ETag in If-Match")
+	}
+
+	for _, tag := range splitETags(header) {
+		if tag == "*" {
+			return 0, nil
+		}
+		// * If-Match uses the strong comparison, weak tags never match
+		if strings.HasPrefix(tag, "W/") || len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		if version, err := strconv.ParseUint(tag[1:len(tag)-1], 10, 32); err == nil && version > 0 {
+			return uint(version), nil
+		}
+	}
+
+	return 0, newProblem(fiber.StatusPreconditionFailed, "If-Match does not name a version of this book")
+}
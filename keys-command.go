@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// * runKeysCommand is "go run . keys <rotate|list|prune>", it manages the files in JWT_KEYS_DIR.
+// * Servers reload the directory every minute, so a rotation never needs a restart.
+func runKeysCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: keys <rotate|list|prune> [flags]")
+	}
+
+	fs := flag.NewFlagSet("keys "+args[0], flag.ContinueOnError)
+	dir := fs.String("dir", jwtKeysDir, "key directory (JWT_KEYS_DIR)")
+	alg := fs.String("alg", "RS256", "algorithm of the new key, RS256 or EdDSA (rotate)")
+	grace := fs.Duration("grace", 5*time.Minute, "extra time on top of ACCESS_TOKEN_TTL before a retired key is removed (prune)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return fmt.Errorf("set JWT_KEYS_DIR or pass -dir")
+	}
+
+	switch args[0] {
+	case "rotate":
+		// * the new key is published first and signs after keyActivationDelay, the old ones stay and keep
+		// * verifying tokens already out there
+		kid, err := generateSigningKey(*dir, *alg)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created %s key %s, it is published within a minute and signs new tokens after %s\n", *alg, kid, keyActivationDelay)
+		fmt.Println("run \"keys prune\" later to remove keys whose tokens have all expired")
+		return nil
+
+	case "list":
+		keys, active, err := loadKeysWithActive(*dir)
+		if err != nil {
+			return err
+		}
+		for _, kid := range sortedKids(keys) {
+			status := "retired"
+			switch {
+			case kid == active:
+				status = "active"
+			case kid > active && jwtSigningKid != "":
+				status = "published (JWT_SIGNING_KID pins " + active + ")"
+			case kid > active:
+				status = "published, signs from " + keys[kid].created.Add(keyActivationDelay).Format(time.RFC3339)
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", kid, keys[kid].method.Alg(), keys[kid].created.Format(time.RFC3339), status)
+		}
+		return nil
+
+	case "prune":
+		keys, active, err := loadKeysWithActive(*dir)
+		if err != nil {
+			return err
+		}
+		// * a key retires when the key after it becomes active, once every access token it signed has expired it
+		// * can go. The active key and the ones after it always stay. With JWT_SIGNING_KID we can't tell when it
+		// * was pinned, so wait ACCESS_TOKEN_TTL after changing it before pruning.
+		kids := sortedKids(keys)
+		for i := 0; kids[i] < active; i++ {
+			retired := keys[kids[i+1]].created.Add(keyActivationDelay)
+			if time.Since(retired) < accessTokenTTL+*grace {
+				continue
+			}
+			if err := os.Remove(filepath.Join(*dir, kids[i]+".pem")); err != nil {
+				return err
+			}
+			fmt.Printf("removed %s\n", kids[i])
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown keys command %q", args[0])
+	}
+}
+
+// * loadKeysWithActive reads the key directory and finds the key servers sign with, honoring JWT_SIGNING_KID
+func loadKeysWithActive(dir string) (map[string]*signingKey, string, error) {
+	keys, err := loadSigningKeys(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(keys) == 0 {
+		return nil, "", fmt.Errorf("no *.pem keys in %s", dir)
+	}
+
+	active := activeKid(keys, jwtSigningKid, time.Now())
+	if _, ok := keys[active]; !ok {
+		return nil, "", fmt.Errorf("JWT_SIGNING_KID %q is not in %s", active, dir)
+	}
+	return keys, active, nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// * signingKey is one private key from JWT_KEYS_DIR, the file name (minus .pem) is its kid
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	public  crypto.PublicKey
+	created time.Time
+}
+
+// * keySet holds every key we accept tokens from, the active one (see activeKid) signs new tokens.
+// * Keeping the older keys around is what lets a rotation happen without logging anybody out.
+type keySet struct {
+	mu     sync.RWMutex
+	keys   map[string]*signingKey
+	active *signingKey
+	secret []byte // * HS256 fallback when no key directory is configured
+}
+
+var signingKeys = new(keySet)
+
+var ErrUnknownSigningKey = errors.New("token signed with an unknown key")
+
+// * kidTimeFormat makes kids sort by creation time, so the newest key is simply the largest kid
+const kidTimeFormat = "20060102T150405Z"
+
+const (
+	keyReloadInterval = time.Minute     // * how often servers reread the key directory
+	jwksMaxAge        = 5 * time.Minute // * how long consumers may cache /.well-known/jwks.json
+
+	// * a new key is only published (and verifies) at first, it starts signing once every server has reloaded
+	// * and every JWKS cache has expired, so no replica or consumer sees a token from a key it doesn't know yet
+	keyActivationDelay = keyReloadInterval + jwksMaxAge + time.Minute
+)
+
+// * kidCreated reads the creation time from the kid, file times change when keys are copied or restored
+func kidCreated(kid string) (time.Time, error) {
+	if len(kid) >= len(kidTimeFormat) {
+		if created, err := time.Parse(kidTimeFormat, kid[:len(kidTimeFormat)]); err == nil {
+			return created, nil
+		}
+	}
+	// * without it we could neither order the key nor tell when it may sign or be pruned
+	return time.Time{}, fmt.Errorf("key %s: the file name must start with its UTC creation time, e.g. %s-mykey.pem, "+
+		"or create keys with: go run . keys rotate", kid, time.Now().UTC().Format(kidTimeFormat))
+}
+
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", key)
+	}
+}
+
+func newSigningKey(kid string, private crypto.Signer, created time.Time) (*signingKey, error) {
+	key := &signingKey{kid: kid, private: private, public: private.Public(), created: created}
+
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("key %s: RSA keys must be at least 2048 bits", kid)
+		}
+		key.method = jwt.SigningMethodRS256
+	case ed25519.PrivateKey:
+		key.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("key %s: unsupported key type %T", kid, private)
+	}
+
+	return key, nil
+}
+
+// * loadSigningKeys reads every *.pem in dir
+func loadSigningKeys(dir string) (map[string]*signingKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*signingKey, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		private, err := parsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		created, err := kidCreated(kid)
+		if err != nil {
+			return nil, err
+		}
+		key, err := newSigningKey(kid, private, created)
+		if err != nil {
+			return nil, err
+		}
+		keys[kid] = key
+	}
+
+	return keys, nil
+}
+
+func sortedKids(keys map[string]*signingKey) []string {
+	kids := make([]string, 0, len(keys))
+	for kid := range keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	return kids
+}
+
+// * activeKid picks the signing key: the pinned one, otherwise the newest key published for at least
+// * keyActivationDelay. A fresh key directory has no such key yet, then its oldest key signs right away.
+func activeKid(keys map[string]*signingKey, pinned string, now time.Time) string {
+	if pinned != "" {
+		return pinned
+	}
+
+	kids := sortedKids(keys)
+	for i := len(kids) - 1; i >= 0; i-- {
+		if !now.Before(keys[kids[i]].created.Add(keyActivationDelay)) {
+			return kids[i]
+		}
+	}
+	return kids[0]
+}
+
+// * load (re)reads the key directory, pinnedKid pins the signing key, see activeKid otherwise
+func (ks *keySet) load(dir, pinnedKid string) error {
+	keys, err := loadSigningKeys(dir)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no *.pem keys in %s, create one with: go run . keys rotate", dir)
+	}
+
+	kid := activeKid(keys, pinnedKid, time.Now())
+	active, ok := keys[kid]
+	if !ok {
+		return fmt.Errorf("JWT_SIGNING_KID %q is not in %s", kid, dir)
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if ks.active != nil && ks.active.kid != active.kid {
+		log.Printf("Signing key %s is now active", active.kid)
+	}
+	ks.keys, ks.active = keys, active
+
+	return nil
+}
+
+// * watch reloads the key directory so keys added by "keys rotate" are picked up (and later activated) without a restart
+func (ks *keySet) watch(dir, pinnedKid string, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := ks.load(dir, pinnedKid); err != nil {
+				log.Printf("Error reload signing keys: %v", err)
+			}
+		}
+	}()
+}
+
+func (ks *keySet) sign(claims jwt.Claims) (string, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if ks.active == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ks.secret)
+	}
+
+	token := jwt.NewWithClaims(ks.active.method, claims)
+	token.Header["kid"] = ks.active.kid
+	return token.SignedString(ks.active.private)
+}
+
+// * keyfunc only hands out a key when the token's kid is ours and its alg is the one that key signs with,
+// * so a token can never pick its own algorithm (no "none", no HS256 signed with a public key)
+func (ks *keySet) keyfunc(token *jwt.Token) (interface{}, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if ks.keys == nil {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		return ks.secret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, ErrUnknownSigningKey
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("key %s does not sign with %s", kid, token.Method.Alg())
+	}
+
+	return key.public, nil
+}
+
+func (ks *keySet) parse(tokenStr string, claims jwt.Claims) (*jwt.Token, error) {
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{
+		jwt.SigningMethodRS256.Alg(),
+		jwt.SigningMethodEdDSA.Alg(),
+		jwt.SigningMethodHS256.Alg(),
+	}))
+	return parser.ParseWithClaims(tokenStr, claims, ks.keyfunc)
+}
+
+type JWK struct {
+	Kty string `json:"kty" example:"RSA"`
+	Kid string `json:"kid" example:"20250102T150405Z-a1b2c3"`
+	Use string `json:"use" example:"sig"`
+	Alg string `json:"alg" example:"RS256"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty" example:"AQAB"`
+	Crv string `json:"crv,omitempty" example:"Ed25519"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// * jwks is the public half of every key, the HS256 fallback secret is of course never published
+func (ks *keySet) jwks() JWKSet {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	set := JWKSet{Keys: []JWK{}}
+	for _, kid := range sortedKids(ks.keys) {
+		key := ks.keys[kid]
+		jwk := JWK{Kid: kid, Use: "sig", Alg: key.method.Alg()}
+
+		switch pub := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set
+}
+
+// * setupSigningKeys uses the key directory when there is one, otherwise HS256 with JWT_SECRET_KEY
+func setupSigningKeys() error {
+	if jwtKeysDir == "" {
+		if jwtSecretKey == "" {
+			return errors.New("set JWT_KEYS_DIR (RS256/EdDSA keys) or JWT_SECRET_KEY (HS256)")
+		}
+		signingKeys.secret = []byte(jwtSecretKey)
+		return nil
+	}
+
+	if err := signingKeys.load(jwtKeysDir, jwtSigningKid); err != nil {
+		return err
+	}
+	signingKeys.watch(jwtKeysDir, jwtSigningKid, keyReloadInterval)
+
+	return nil
+}
+
+// * generateSigningKey writes a new private key into dir and returns its kid
+func generateSigningKey(dir, alg string) (string, error) {
+	var private crypto.Signer
+	var err error
+
+	switch alg {
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 3072)
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return "", fmt.Errorf("unsupported algorithm %q, use RS256 or EdDSA", alg)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+
+	kid := time.Now().UTC().Format(kidTimeFormat) + "-" + hex.EncodeToString(suffix)
+	path := filepath.Join(dir, kid+".pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	// * O_EXCL so a kid collision fails instead of overwriting a key
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return "", err
+	}
+
+	return kid, nil
+}
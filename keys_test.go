@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadSigningKeysRejectsKidsWithoutCreationTime(t *testing.T) {
+	dir := t.TempDir()
+	kid, err := generateSigningKey(dir, "EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadSigningKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created := keys[kid].created; time.Since(created) > time.Minute {
+		t.Fatalf("key %s was created at %s", kid, created)
+	}
+
+	// * a key copied in by hand, it would sort after every rotated key and have no age
+	data, err := os.ReadFile(filepath.Join(dir, kid+".pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "mykey.pem"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSigningKeys(dir); err == nil {
+		t.Fatal("loaded a key whose kid has no creation time")
+	}
+
+	if err := os.Rename(filepath.Join(dir, "mykey.pem"), filepath.Join(dir, "20200101T000000Z-mykey.pem")); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = loadSigningKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created := keys["20200101T000000Z-mykey"].created; !created.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("renamed key was created at %s", created)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	netmail "net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// * Mail is a plain text email
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// * Mailer delivers the emails the API sends (password resets, ...), pick one with MAILER
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+// * logMailer prints emails to the server log, the default for local development
+type logMailer struct{}
+
+func (logMailer) Send(mail Mail) error {
+	log.Printf("Mail to %s: %s\n%s", mail.To, mail.Subject, mail.Body)
+	return nil
+}
+
+// * fileMailer writes every email as a .eml file into dir, handy to click the links in them
+type fileMailer struct {
+	dir string
+}
+
+func (m fileMailer) Send(mail Mail) error {
+	if err := os.MkdirAll(m.dir, 0o700); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000Z"),
+		strings.NewReplacer("@", "_at_", "/", "_").Replace(mail.To))
+	data := fmt.Sprintf("To: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		mail.To, mail.Subject, time.Now().Format(time.RFC1123Z), mail.Body)
+
+	return os.WriteFile(filepath.Join(m.dir, name), []byte(data), 0o600)
+}
+
+// * smtpMailer sends through an SMTP server, e.g. the mailpit service of docker-compose.yml
+type smtpMailer struct {
+	addr   string // * host:port
+	auth   smtp.Auth
+	from   string // * the From: header, e.g. Book API <no-reply@localhost>
+	sender string // * the bare address of from, MAIL FROM takes no display name
+}
+
+func (m smtpMailer) Send(mail Mail) error {
+	data := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		m.from, mail.To, mail.Subject, time.Now().Format(time.RFC1123Z), mail.Body)
+
+	return smtp.SendMail(m.addr, m.auth, m.sender, []string{mail.To}, []byte(data))
+}
+
+var mailer Mailer = logMailer{}
+
+// * setupMailer picks the mailer from MAILER (log, file or smtp)
+func setupMailer(kind, dir string) error {
+	switch kind {
+	case "", "log":
+		mailer = logMailer{}
+	case "file":
+		mailer = fileMailer{dir: dir}
+	case "smtp":
+		if smtpAddr == "" {
+			return errors.New("MAILER=smtp needs SMTP_ADDR")
+		}
+		from, err := netmail.ParseAddress(mailFrom)
+		if err != nil {
+			return fmt.Errorf("invalid MAIL_FROM %q: %w", mailFrom, err)
+		}
+		m := smtpMailer{addr: smtpAddr, from: mailFrom, sender: from.Address}
+		if smtpUsername != "" {
+			host, _, _ := strings.Cut(smtpAddr, ":")
+			m.auth = smtp.PlainAuth("", smtpUsername, smtpPassword, host)
+		}
+		mailer = m
+	default:
+		return fmt.Errorf("unknown MAILER %q, use log, file or smtp", kind)
+	}
+	return nil
+}
+
+// * sendMail delivers in the background, so a slow mail server doesn't hold the request
+// * (and the response time doesn't tell whether an email was sent at all)
+func sendMail(mail Mail) {
+	go func() {
+		if err := mailer.Send(mail); err != nil {
+			log.Printf("Error send mail to %s: %v", mail.To, err)
+		}
+	}()
+}
@@ -1,77 +1,157 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/MadManJJ/go-gorm/docs"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/gofiber/swagger"
-	"github.com/golang-jwt/jwt/v4"
-	"github.com/joho/godotenv"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
-func init() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
-	host = "localhost"
-	databaseName = os.Getenv("POSTGRES_DB")
-	username = os.Getenv("POSTGRES_USER")
-	password = os.Getenv("POSTGRES_PASSWORD")
-}
-
+// * set from Config.apply at startup, see defaultConfig for their defaults
 var (
-	host         string
-	port         = 5432
-	databaseName string
-	username     string
-	password     string
 	gormdb *gorm.DB
+
+	adminEmail      string
+	jwtSecretKey    string // * HS256 secret, only used without jwtKeysDir
+	jwtKeysDir      string // * directory of RS256/EdDSA private keys, empty means HS256 with jwtSecretKey
+	jwtSigningKid   string // * pins the signing key, empty means the newest key in jwtKeysDir
+	jwtIssuer       string
+	jwtAudience     string
+	trashRetention  time.Duration // * how long soft-deleted books stay in the trash
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+
+	sessionIdleTimeout     time.Duration // * a cookie session ends after this long without requests
+	sessionAbsoluteTimeout time.Duration // * and after this long no matter what
+
+	passwordResetTTL time.Duration
+	passwordResetURL string // * page of the frontend that resets passwords, the token is appended as ?token=
+	mailerKind       string
+	mailDir          string
+	smtpAddr         string
+	smtpUsername     string
+	smtpPassword     string
+	mailFrom         string
+	publicURL        string // * where clients reach this API, used for links in emails
+
+	emailVerificationSecret []byte // * HMAC key of verification links
+	emailVerificationTTL    time.Duration
+
+	oidcIssuer       string // * OpenID Connect provider for single sign-on, empty turns it off
+	oidcClientID     string
+	oidcClientSecret string
+	oidcRedirectURL  string // * must be registered at the provider, defaults to PUBLIC_URL/auth/oidc/callback
+	oidcScopes       []string
 )
 
+type MessageResponse struct {
+	Message string `json:"message" example:"Delete Book Successful"`
+}
+
+// * bookProblem maps the errors of the book model functions to the matching problem
+func bookProblem(err error, detail string) error {
+	switch {
+	case errors.Is(err, ErrBookNotFound):
+		return newProblem(fiber.StatusNotFound, err.Error())
+	case errors.Is(err, ErrBookVersionMismatch):
+		return newProblem(fiber.StatusPreconditionFailed, err.Error())
+	default:
+		return internalProblem(detail, err)
+	}
+}
+
 func authRequired(c *fiber.Ctx) error {
-    // First check for JWT in Authorization header
-    tokenStr := c.Get("Authorization")
-    if tokenStr == "" {
-        // Fallback to cookie if no Authorization header is provided
-        tokenStr = c.Cookies("jwt")
-    }
-    if tokenStr == "" {
-        return c.SendStatus(fiber.StatusUnauthorized)
-    }
-
-    // Strip "Bearer " if it's in the Authorization header
-    if len(tokenStr) > 7 && tokenStr[:7] == "Bearer " {
-        tokenStr = tokenStr[7:]
-    }
-
-    jwtSecretKey := os.Getenv("JWT_SECRET_KEY")
-    token, err := jwt.ParseWithClaims(tokenStr, jwt.MapClaims{}, func(token *jwt.Token) (interface{}, error) {
-        return []byte(jwtSecretKey), nil
-    })
-
-    if err != nil || !token.Valid {
-        return c.SendStatus(fiber.StatusUnauthorized)
-    }
-
-    claim := token.Claims.(jwt.MapClaims)
-    fmt.Println(claim["user_id"])
-
-    return c.Next()
+	return authenticate(c, false)
 }
 
+// * authenticate checks the bearer token. Tokens issued to OAuth clients only carry book scopes,
+// * so they are only let through (allowClients) on routes that check scopes.
+func authenticate(c *fiber.Ctx, allowClients bool) error {
+	// First check for JWT in Authorization header
+	tokenStr := c.Get("Authorization")
+	if tokenStr == "" {
+		// * browsers in cookie mode, a bearer token (Swagger UI) wins when both are there
+		if session := c.Cookies(sessionCookie); session != "" {
+			return authenticateSessionCookie(c, session)
+		}
+		return newProblem(fiber.StatusUnauthorized, "missing authentication token")
+	}
+
+	// Strip "Bearer " if it's in the Authorization header
+	if len(tokenStr) > 7 && tokenStr[:7] == "Bearer " {
+		tokenStr = tokenStr[7:]
+	}
+
+	claims := new(AccessClaims)
+	token, err := signingKeys.parse(tokenStr, claims)
+	if err != nil || !token.Valid {
+		return newProblem(fiber.StatusUnauthorized, "invalid or expired token")
+	}
+	if err := claims.validate(); err != nil {
+		return newProblem(fiber.StatusUnauthorized, err.Error())
+	}
+
+	if claims.ClientID != "" && !allowClients {
+		return newProblem(fiber.StatusForbidden, "OAuth client tokens only work for the /books endpoints")
+	}
+
+	revoked, err := tokenRevoked(gormdb, claims.ID, claims.SessionID)
+	if err != nil {
+		return internalProblem("could not check token", err)
+	}
+	if revoked {
+		return newProblem(fiber.StatusUnauthorized, "token has been revoked")
+	}
+
+	if claims.ClientID != "" {
+		active, err := oauthClientActive(gormdb, claims.ClientID)
+		if err != nil {
+			return internalProblem("could not check OAuth client", err)
+		}
+		if !active {
+			return newProblem(fiber.StatusUnauthorized, "the OAuth client was revoked")
+		}
+	}
+
+	// * client credentials tokens have no user
+	if claims.UserID != 0 || claims.ClientID == "" {
+		disabled, err := accountDisabled(gormdb, claims.UserID)
+		if err != nil {
+			return internalProblem("could not check account", err)
+		}
+		if disabled {
+			return newProblem(fiber.StatusForbidden, ErrAccountDisabled.Error())
+		}
+	}
+
+	principal := newPrincipal(claims)
+	if principal.ImpersonatorID != 0 {
+		// * so clients (and whoever reads their logs) can't miss that this is not the user themselves
+		c.Set("X-Impersonated-By", strconv.FormatUint(uint64(principal.ImpersonatorID), 10))
+	}
+	c.Locals(principalKey, principal)
+
+	return c.Next()
+}
 
 // @title Book API
 // @description This is a sample server for a book API.
+// @description Every error response is an RFC 7807 problem document (application/problem+json),
+// @description see the Problem model. The request_id matches the X-Request-ID response header.
 // @version 1.0
 // @host localhost:8080
 // @BasePath /
@@ -79,48 +159,193 @@ func authRequired(c *fiber.Ctx) error {
 // @securityDefinitions.apikey ApiKeyAuth
 // @in header
 // @name Authorization
+// @description Bearer JWT from POST /login. Every user has one role, reader < editor < admin, and each role can do
+// @description everything the roles before it can. The role an operation needs is in its x-required-role field.
+// @description Access tokens of OAuth clients from POST /oauth/token go here too, they only work for /books.
+// @description Browsers can use a session cookie instead, see POST /login?mode=cookie.
+// @securityDefinitions.apikey MachineKeyAuth
+// @in header
+// @name X-API-Key
+// @description API key from POST /me/api-keys, for the /books endpoints. It acts as its user, limited to its
+// @description scopes, the scope an operation needs is in its x-required-scope field.
+// @securityDefinitions.basic OAuthClientAuth
+// @description client_id and client_secret of an OAuth client from POST /oauth/clients, for the /oauth token endpoints.
 func main() {
-	dsn := fmt.Sprintf("host=%s port=%d user=%s "+
-  "password=%s dbname=%s sslmode=disable",
-  host, port, username, password, databaseName)
+	// * go run . keys <rotate|list|prune>
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		mustApplyConfig(nil)
+		if err := runKeysCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg := mustApplyConfig(os.Args[1:])
+	if err := cfg.validate(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Config:%s", cfg)
+
+	if err := setupMailer(mailerKind, mailDir); err != nil {
+		log.Fatalf("Error setup mailer: %v", err)
+	}
+	if err := setupSigningKeys(); err != nil {
+		log.Fatalf("Error load signing keys: %v", err)
+	}
+	if len(emailVerificationSecret) == 0 {
+		// ! links mailed before a restart stop working, set EMAIL_VERIFICATION_SECRET outside development
+		log.Println("EMAIL_VERIFICATION_SECRET is not set, using a random one")
+		emailVerificationSecret = make([]byte, 32)
+		if _, err := rand.Read(emailVerificationSecret); err != nil {
+			log.Fatalf("Error generate verification secret: %v", err)
+		}
+	}
+	if oidcIssuer != "" {
+		if err := setupOIDC(context.Background(), oidcIssuer, oidcClientID, oidcClientSecret, oidcRedirectURL, oidcScopes); err != nil {
+			log.Fatalf("Error setup OpenID Connect: %v", err)
+		}
+	}
 
 	// New logger for detailed SQL logging
 	newLogger := logger.New(
 		log.New(os.Stdout, "\r\n", log.LstdFlags), // io writer
 		logger.Config{
-			SlowThreshold: time.Second, // Slow SQL threshold
-			LogLevel:      logger.Info, // Log level
-			Colorful:      true,        // Enable color
+			SlowThreshold: time.Second,             // Slow SQL threshold
+			LogLevel:      logLevels[cfg.LogLevel], // Log level
+			Colorful:      true,                    // Enable color
 		},
 	)
 
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
-		Logger: newLogger,
+	db, err := gorm.Open(postgres.Open(cfg.Database.dsn()), &gorm.Config{
+		Logger:         newLogger,
+		TranslateError: true, // * turns unique violations into gorm.ErrDuplicatedKey
 	})
 
 	if err != nil {
 		panic("failed to connect database")
 	}
 	gormdb = db
-	gormdb.AutoMigrate(&Book{}, &User{}) // * AutoMigrate won't delete col, it can only create col
+	verifyExisting := !gormdb.Migrator().HasColumn(&User{}, "EmailVerifiedAt")
+	if err := migrateRoles(gormdb); err != nil {
+		log.Fatalf("Error migrate roles: %v", err)
+	}
+	err = gormdb.AutoMigrate(&Book{}, &User{}, &RefreshToken{}, &RevokedToken{}, &PasswordResetToken{}, &MFARecoveryCode{}, &Setting{}, &LoginThrottle{}, &APIKey{}, &UserIdentity{}, &OIDCLoginState{}, &OAuthClient{}, &OAuthAuthorizationCode{}, &Session{}, &AuditEntry{}) // * AutoMigrate won't delete col, it can only create col
+	if err != nil {
+		log.Fatalf("Error migrate: %v", err)
+	}
+	if err := migrateBookSearch(gormdb); err != nil {
+		log.Fatalf("Error migrate book search: %v", err)
+	}
+	if err := migrateUserEmailIndex(gormdb); err != nil {
+		log.Fatalf("Error migrate user email index: %v", err)
+	}
+	if err := migrateAuditLog(gormdb); err != nil {
+		log.Fatalf("Error migrate audit log: %v", err)
+	}
+	if verifyExisting {
+		if err := verifyExistingUsers(gormdb); err != nil {
+			log.Fatalf("Error migrate email verification: %v", err)
+		}
+	}
+	if adminEmail != "" {
+		if err := promoteAdmin(gormdb, adminEmail); err != nil {
+			log.Fatalf("Error promote admin: %v", err)
+		}
+	}
+
+	if err := loadMFAPolicy(gormdb); err != nil {
+		log.Fatalf("Error load MFA policy: %v", err)
+	}
+	watchMFAPolicy(gormdb, time.Minute)
+
+	startTrashPurger(gormdb, trashRetention, time.Hour)
+	startTokenJanitor(gormdb, time.Hour)
 
-	app := fiber.New()
+	app := fiber.New(fiber.Config{
+		ErrorHandler: problemErrorHandler, // * every error becomes application/problem+json
+	})
+	app.Use(requestid.New())
 	app.Get("/swagger/*", swagger.HandlerDefault)
-	
-	app.Use("/books", authRequired) // * Middleware
+	app.Get("/.well-known/jwks.json", GetJWKS)
+
+	app.Use("/books", apiKeyOrAuthRequired) // * Middleware
+	verified := requireVerifiedEmail        // * unverified users can read books but not change them
+	app.Use("/users", authRequired, requireRole(RoleAdmin))
+	app.Use("/settings", authRequired, requireRole(RoleAdmin))
+	app.Use("/me", authRequired)
+	app.Use("/oauth/clients", authRequired, requireRole(RoleAdmin))
+	app.Use("/audit", authRequired, requireRole(RoleAdmin))
 
 	// * Books
-	app.Get("/books", GetBooks)
-	app.Get("/books/:id", GetBook)
-	app.Post("/books", CreateBook)
-	app.Put("/books/:id", UpdateBook)
-	app.Delete("/books/:id", DeleteBook)
+	reader, editor, admin := requireRole(RoleReader), requireRole(RoleEditor), requireRole(RoleAdmin)
+	read, write := requireScope(ScopeBooksRead), requireScope(ScopeBooksWrite) // * login tokens have their role's scopes
+	app.Get("/books", reader, read, GetBooks)
+	app.Get("/books/search", reader, read, SearchBooks) // * must come before /books/:id
+	app.Get("/books/trash", admin, read, GetTrash)
+	app.Get("/books/:id", reader, read, GetBook)
+	app.Post("/books/:id/restore", admin, write, verified, RestoreBook)
+	app.Post("/books", editor, write, verified, CreateBook)
+	app.Put("/books/:id", editor, write, verified, UpdateBook)
+	app.Patch("/books/:id", editor, write, verified, PatchBook)
+	app.Delete("/books/:id", editor, write, verified, DeleteBook)
+
+	// * Users
+	app.Get("/users", GetUsers)
+	app.Get("/users/:id", GetUser)
+	app.Put("/users/:id/role", UpdateUserRole)
+	app.Post("/users/:id/disable", DisableUser)
+	app.Post("/users/:id/enable", EnableUser)
+	app.Post("/users/:id/password-reset", ForcePasswordReset)
+	app.Post("/users/:id/impersonate", ImpersonateUser)
+	app.Get("/users/:id/api-keys", GetUserAPIKeys)
+	app.Delete("/users/:id/api-keys/:keyID", RevokeUserAPIKey)
+
+	// * Settings
+	app.Get("/settings/mfa", GetMFAPolicy)
+	app.Put("/settings/mfa", UpdateMFAPolicy)
+
+	// * Audit
+	app.Get("/audit/events", GetAuditEvents)
+	app.Get("/audit/verify", VerifyAuditLog)
+
+	// * Me
+	app.Get("/me", GetMe)
+	app.Patch("/me", PatchMe)
+	app.Delete("/me", denyImpersonation, DeleteMe)
+	app.Put("/me/password", denyImpersonation, ChangePassword)
+	app.Put("/me/email", denyImpersonation, ChangeEmail)
+	app.Post("/me/mfa/totp", denyImpersonation, EnrollTOTP)
+	app.Post("/me/mfa/totp/confirm", denyImpersonation, ConfirmTOTP)
+	app.Delete("/me/mfa/totp", denyImpersonation, DisableMFA)
+	app.Post("/me/api-keys", denyImpersonation, CreateAPIKey)
+	app.Get("/me/api-keys", GetAPIKeys)
+	app.Delete("/me/api-keys/:id", denyImpersonation, RevokeAPIKey)
+
+	// * OAuth, for third-party apps
+	app.Post("/oauth/clients", CreateOAuthClient)
+	app.Get("/oauth/clients", GetOAuthClients)
+	app.Delete("/oauth/clients/:id", RevokeOAuthClient)
+	app.Post("/oauth/authorize", authRequired, denyImpersonation, AuthorizeOAuthClient)
+	app.Post("/oauth/token", OAuthToken)
+	app.Post("/oauth/introspect", IntrospectOAuthToken)
+	app.Post("/oauth/revoke", RevokeOAuthToken)
 
 	// * Auth
 	app.Post("/register", Register)
 	app.Post("/login", LoginUser)
+	app.Post("/login/mfa", LoginMFA)
+	app.Post("/token/refresh", RefreshTokens)
+	app.Post("/logout", authRequired, Logout)
+	app.Post("/password/forgot", ForgotPassword)
+	app.Post("/password/reset", ResetPassword)
+	app.Get("/email/verify", VerifyEmail)
+	app.Get("/auth/oidc/login", OIDCLogin)
+	app.Get("/auth/oidc/callback", OIDCCallback)
+	app.Post("/email/verify/resend", resendLimiter, authRequired, ResendVerification)
 
-	app.Listen(":8080")
+	if err := app.Listen(cfg.ListenAddr); err != nil {
+		log.Fatalf("Error listen on %s: %v", cfg.ListenAddr, err)
+	}
 
 	// * Create Book
 	// createBook(db, &Book{
@@ -132,40 +357,244 @@ func main() {
 	// * --------------------------------
 
 	// * Get Book
-	// currentBook := getBook(db,1)
+	// currentBook, err := getBook(db,1)
 	// fmt.Println(currentBook)
 	// * --------------------------------
 
 	// * Update Book
-	// currentBook := getBook(db, 1) // getBook return an address
+	// currentBook, err := getBook(db, 1) // getBook return an address
 	// currentBook.Name = "BOBA JOHN"
 	// currentBook.Price = 440
-	// updateBook(db, currentBook)
+	// updateBook(db, currentBook, currentBook.Version)
 	// * --------------------------------
 
 	// * Delete Book
-	// deleteBook(db, 1)
+	// deleteBook(db, 1, 0)
 	// * --------------------------------
-	
+
 	// * Search Book
-	// currentBook := searchBook(db, "suzy")
+	// currentBook, total, err := searchBook(db, "suzy", 1, 20)
 	// fmt.Println(currentBook)
 	// * --------------------------------
 }
 
+// * parseQueryTime accepts either a full RFC 3339 timestamp or a plain date (midnight UTC)
+func parseQueryTime(c *fiber.Ctx, key string) (*time.Time, error) {
+	v := c.Query(key)
+	if v == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", v)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s must be an RFC 3339 timestamp or a YYYY-MM-DD date", key)
+	}
+
+	return &t, nil
+}
+
+func parseQueryPrice(c *fiber.Ctx, key string) (*uint, error) {
+	v := c.Query(key)
+	if v == "" {
+		return nil, nil
+	}
+
+	price, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a non-negative integer", key)
+	}
+
+	p := uint(price)
+	return &p, nil
+}
+
+func parseBookQuery(c *fiber.Ctx) (BookQuery, error) {
+	var q BookQuery
+	var err error
+
+	if q.Page, q.Limit, err = parsePageLimit(c); err != nil {
+		return q, err
+	}
+	if q.Sort, err = parseBookSort(c.Query("sort")); err != nil {
+		return q, err
+	}
+
+	switch c.Query("mode", "page") {
+	case "page":
+	case "cursor":
+		q.CursorMode = true
+	default:
+		return q, errors.New("mode must be page or cursor")
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		cur, err := decodeCursor(cursor)
+		if err != nil {
+			return q, err
+		}
+		q.CursorMode = true
+		q.Cursor = &cur
+	}
+
+	q.Author = c.Query("author")
+	if q.MinPrice, err = parseQueryPrice(c, "min_price"); err != nil {
+		return q, err
+	}
+	if q.MaxPrice, err = parseQueryPrice(c, "max_price"); err != nil {
+		return q, err
+	}
+	if q.CreatedAfter, err = parseQueryTime(c, "created_after"); err != nil {
+		return q, err
+	}
+	if q.CreatedBefore, err = parseQueryTime(c, "created_before"); err != nil {
+		return q, err
+	}
+	if q.UpdatedAfter, err = parseQueryTime(c, "updated_after"); err != nil {
+		return q, err
+	}
+	if q.UpdatedBefore, err = parseQueryTime(c, "updated_before"); err != nil {
+		return q, err
+	}
+
+	return q, nil
+}
+
 // @Summary Get all books
-// @Description Get details of all books
+// @Description Get a page of books. Supports offset pagination (page/limit) and an opaque cursor mode,
+// @Description filtering by author, price range and created/updated date ranges, and sorting by a whitelisted column.
 // @Tags books
 // @Accept  json
 // @Produce  json
 // @Security ApiKeyAuth
-// @Success 200 {array} BookDTO
-// @Failure 400 {string} string "Bad Request"
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 500 {string} string "Internal Server Error"
+// @Security MachineKeyAuth
+// @x-required-role "reader"
+// @x-required-scope "books:read"
+// @Param page query int false "Page number, starting at 1 (page mode only)" minimum(1) maximum(21474836) default(1)
+// @Param limit query int false "Items per page" minimum(1) maximum(100) default(20)
+// @Param mode query string false "Pagination mode" Enums(page, cursor) default(page)
+// @Param cursor query string false "Opaque cursor taken from links.next or links.prev, implies cursor mode"
+// @Param sort query string false "Sort column, prefix with - for descending" Enums(id, -id, name, -name, author, -author, price, -price, created_at, -created_at, updated_at, -updated_at) default(id)
+// @Param author query string false "Case-insensitive partial match on author"
+// @Param min_price query int false "Minimum price (inclusive)" minimum(0)
+// @Param max_price query int false "Maximum price (inclusive)" minimum(0)
+// @Param created_after query string false "Created at or after, RFC 3339 or YYYY-MM-DD"
+// @Param created_before query string false "Created before, RFC 3339 or YYYY-MM-DD"
+// @Param updated_after query string false "Updated at or after, RFC 3339 or YYYY-MM-DD"
+// @Param updated_before query string false "Updated before, RFC 3339 or YYYY-MM-DD"
+// @Success 200 {object} BookPage
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 500 {object} Problem "Internal Server Error"
 // @Router /books [get]
 func GetBooks(c *fiber.Ctx) error {
-	return c.JSON(getBooks(gormdb))
+	q, err := parseBookQuery(c)
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, err.Error())
+	}
+
+	list, err := getBooks(gormdb, q)
+	if errors.Is(err, ErrInvalidCursor) {
+		return newProblem(fiber.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return internalProblem("could not get books", err)
+	}
+
+	page := BookPage{
+		Items: newBookResponses(list.Books),
+		Total: list.Total,
+		Limit: q.Limit,
+	}
+
+	if !q.CursorMode {
+		page.Page = q.Page
+		if int64(q.Page*q.Limit) < list.Total {
+			page.Links.Next = pageLink(c, map[string]string{"page": strconv.Itoa(q.Page + 1)})
+		}
+		if q.Page > 1 {
+			page.Links.Prev = pageLink(c, map[string]string{"page": strconv.Itoa(q.Page - 1)})
+		}
+		return c.JSON(page)
+	}
+
+	if len(list.Books) > 0 {
+		sort := q.Sort.String()
+		first, last := list.Books[0], list.Books[len(list.Books)-1]
+		backwards := q.Cursor != nil && q.Cursor.Prev
+
+		// * walking forward there is a next page when we over-fetched, and a prev page whenever we came from a cursor;
+		// * walking backward it is the other way around
+		if (!backwards && list.HasMore) || backwards {
+			page.Links.Next = pageLink(c, map[string]string{
+				"page":   "",
+				"mode":   "",
+				"cursor": encodeCursor(pageCursor{Sort: sort, Value: bookSortValue(last, q.Sort.Field), ID: last.ID}),
+			})
+		}
+		if (backwards && list.HasMore) || (!backwards && q.Cursor != nil) {
+			page.Links.Prev = pageLink(c, map[string]string{
+				"page":   "",
+				"mode":   "",
+				"cursor": encodeCursor(pageCursor{Sort: sort, Value: bookSortValue(first, q.Sort.Field), ID: first.ID, Prev: true}),
+			})
+		}
+	}
+
+	return c.JSON(page)
+}
+
+// @Summary Search books
+// @Description Full-text search over book name, author and description, ranked by relevance.
+// @Description Words are ANDed together, "quoted words" match as a phrase, a trailing * matches a prefix (wiz*)
+// @Description and a leading - excludes a word. The highlight and snippet fields are HTML: the book text is escaped
+// @Description and matches are wrapped in <mark></mark>, the only tags they contain.
+// @Tags books
+// @Produce  json
+// @Security ApiKeyAuth
+// @Security MachineKeyAuth
+// @x-required-role "reader"
+// @x-required-scope "books:read"
+// @Param q query string true "Search query" example("harry pot*")
+// @Param page query int false "Page number, starting at 1" minimum(1) maximum(21474836) default(1)
+// @Param limit query int false "Items per page" minimum(1) maximum(100) default(20)
+// @Success 200 {object} BookSearchPage
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /books/search [get]
+func SearchBooks(c *fiber.Ctx) error {
+	page, limit, err := parsePageLimit(c)
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, err.Error())
+	}
+
+	books, total, err := searchBook(gormdb, c.Query("q"), page, limit)
+	if errors.Is(err, ErrEmptySearch) {
+		return newProblem(fiber.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return internalProblem("could not search books", err)
+	}
+
+	result := BookSearchPage{
+		Items: newBookSearchResults(books),
+		Total: total,
+		Page:  page,
+		Limit: limit,
+	}
+	if int64(page*limit) < total {
+		result.Links.Next = pageLink(c, map[string]string{"page": strconv.Itoa(page + 1)})
+	}
+	if page > 1 {
+		result.Links.Prev = pageLink(c, map[string]string{"page": strconv.Itoa(page - 1)})
+	}
+
+	return c.JSON(result)
 }
 
 // @Summary Get book
@@ -173,20 +602,37 @@ func GetBooks(c *fiber.Ctx) error {
 // @Tags books
 // @Produce  json
 // @Security ApiKeyAuth
+// @Security MachineKeyAuth
+// @x-required-role "reader"
+// @x-required-scope "books:read"
 // @Param bookID path int true "Book ID"
-// @Success 200 {object} BookDTO
-// @Failure 400 {string} string "Bad Request"
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 404 {string} string "Not Found"
-// @Failure 500 {string} string "Internal Server Error"
+// @Param If-None-Match header string false "ETag from an earlier response, 304 when it still matches"
+// @Success 200 {object} BookResponse
+// @Header 200 {string} ETag "Current version of the book"
+// @Success 304 "Not Modified"
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 404 {object} Problem "Not Found"
+// @Failure 500 {object} Problem "Internal Server Error"
 // @Router /books/{bookID} [get]
 func GetBook(c *fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.SendStatus(fiber.StatusBadRequest)
+		return newProblem(fiber.StatusBadRequest, "book id must be an integer")
 	}
-	book := getBook(gormdb, id)
-	return c.Status(fiber.StatusOK).JSON(book)
+	book, err := getBook(gormdb, id)
+	if err != nil {
+		return bookProblem(err, "could not get book")
+	}
+
+	etag := bookETag(book)
+	c.Set(fiber.HeaderETag, etag)
+	if notModified(c, etag) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(newBookResponse(book))
 }
 
 // @Summary Create book
@@ -195,156 +641,548 @@ func GetBook(c *fiber.Ctx) error {
 // @Accept  json
 // @Produce  json
 // @Security ApiKeyAuth
+// @Security MachineKeyAuth
+// @x-required-role "editor"
+// @x-required-scope "books:write"
 // @Param Book body BookDTO true "Book DTO"
-// @Success 200 {object} map[string]string
-// @Failure 400 {string} string "Bad Request"
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 500 {string} string "Internal Server Error"
+// @Success 201 {object} BookResponse
+// @Header 201 {string} ETag "Version of the new book"
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 500 {object} Problem "Internal Server Error"
 // @Router /books [post]
 func CreateBook(c *fiber.Ctx) error {
-	book := new(Book) // * book is a pointer
-	// var book Book // * book is a regular value
+	dto := new(BookDTO)
 
-	if err := c.BodyParser(book); err != nil {
-		return c.SendStatus(fiber.StatusBadRequest)
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
 	}
 
-	err := createBook(gormdb, book)
+	dto.normalize()
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
+
+	book := dto.toBook() // * book is a pointer
+	book.CreatedBy = actorID(c)
+	book.UpdatedBy = book.CreatedBy
+
+	err := gormdb.Transaction(func(tx *gorm.DB) error {
+		if err := createBook(tx, book); err != nil {
+			return err
+		}
+		return recordAuditTx(tx, c, bookChangeEvent("book.created", nil, book))
+	})
 
 	if err != nil {
-		return c.SendStatus(fiber.StatusBadRequest)
+		return internalProblem("could not create book", err)
 	}
 
-	return c.JSON(fiber.Map{
-		"message" : "Create Book Successful",
-	})
+	c.Set(fiber.HeaderETag, bookETag(book))
+	return c.Status(fiber.StatusCreated).JSON(newBookResponse(book))
 }
 
 // @Summary Update book
-// @Description Update book
+// @Description Replace every editable field of a book, fields left out are cleared (description) or rejected (name, author, price)
 // @Tags books
 // @Accept  json
 // @Produce  json
 // @Security ApiKeyAuth
+// @Security MachineKeyAuth
+// @x-required-role "editor"
+// @x-required-scope "books:write"
 // @Param bookID path int true "Book ID"
+// @Param If-Match header string true "ETag from GET /books/{bookID}, or * for any version"
 // @Param Book body BookDTO true "Book DTO"
-// @Success 200 {object} map[string]string
-// @Failure 400 {string} string "Bad Request"
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 500 {string} string "Internal Server Error"
+// @Success 200 {object} BookResponse
+// @Header 200 {string} ETag "New version of the book"
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 404 {object} Problem "Not Found"
+// @Failure 412 {object} Problem "Precondition Failed"
+// @Failure 428 {object} Problem "Precondition Required"
+// @Failure 500 {object} Problem "Internal Server Error"
 // @Router /books/{bookID} [put]
 func UpdateBook(c *fiber.Ctx) error {
-		id, err := strconv.Atoi(c.Params("id"))
-		if err != nil {
-			return c.SendStatus(fiber.StatusBadRequest)
-		}
-		book := new(Book)
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, "book id must be an integer")
+	}
+	version, err := requiredVersion(c)
+	if err != nil {
+		return err
+	}
+	dto := new(BookDTO)
 
-		if err := c.BodyParser(book); err != nil {
-			return c.SendStatus(fiber.StatusBadRequest)
-		}
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
 
-		book.ID = uint(id)
+	dto.normalize()
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
 
-		err = updateBook(gormdb, book)
+	book := dto.toBook()
+	book.ID = uint(id)
+	book.UpdatedBy = actorID(c)
 
+	// * the audit entry commits with the update or not at all
+	err = gormdb.Transaction(func(tx *gorm.DB) error {
+		before, err := getBook(tx, id)
 		if err != nil {
-			return c.SendStatus(fiber.StatusBadRequest)
+			return err
+		}
+		if err := updateBook(tx, book, version); err != nil {
+			return err
 		}
+		if book, err = getBook(tx, id); err != nil {
+			return err
+		}
+		return recordAuditTx(tx, c, bookChangeEvent("book.updated", before, book))
+	})
 
-		return c.JSON(fiber.Map{
-			"message" : "Update Book Successful",
-		})
+	if err != nil {
+		return bookProblem(err, "could not update book")
+	}
+
+	c.Set(fiber.HeaderETag, bookETag(book))
+	return c.JSON(newBookResponse(book))
+}
+
+// @Summary Patch book
+// @Description Partially update a book.
+// @Description application/merge-patch+json (RFC 7396): send only the fields to change, null clears description.
+// @Description application/json-patch+json (RFC 6902): send an array of operations, e.g. [{"op":"replace","path":"/price","value":0}].
+// @Description Plain application/json is treated as a merge patch.
+// @Tags books
+// @Accept application/merge-patch+json
+// @Accept application/json-patch+json
+// @Accept json
+// @Produce  json
+// @Security ApiKeyAuth
+// @Security MachineKeyAuth
+// @x-required-role "editor"
+// @x-required-scope "books:write"
+// @Param bookID path int true "Book ID"
+// @Param If-Match header string true "ETag from GET /books/{bookID}, or * for any version"
+// @Param Patch body object true "Merge patch object or JSON patch operation array"
+// @Success 200 {object} BookResponse
+// @Header 200 {string} ETag "New version of the book"
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 404 {object} Problem "Not Found"
+// @Failure 415 {object} Problem "Unsupported Media Type"
+// @Failure 422 {object} Problem "Unprocessable Entity"
+// @Failure 412 {object} Problem "Precondition Failed"
+// @Failure 428 {object} Problem "Precondition Required"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /books/{bookID} [patch]
+func PatchBook(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, "book id must be an integer")
+	}
+
+	version, err := requiredVersion(c)
+	if err != nil {
+		return err
+	}
+
+	book, err := getBook(gormdb, id)
+	if err != nil {
+		return bookProblem(err, "could not get book")
+	}
+	if version != 0 && version != book.Version {
+		return bookProblem(ErrBookVersionMismatch, "")
+	}
+
+	dto := new(BookDTO)
+	if err := applyPatch(newBookDTO(book), c.Get(fiber.HeaderContentType), c.Body(), dto); err != nil {
+		return err
+	}
+
+	dto.normalize()
+	if err := validateStruct(dto); err != nil {
+		return err
 	}
 
+	patched := dto.toBook()
+	patched.ID = book.ID
+	patched.UpdatedBy = actorID(c)
+
+	before := book
+	err = gormdb.Transaction(func(tx *gorm.DB) error {
+		// * the patch was applied to the version we read, so that is the one the write must still find
+		if err := updateBook(tx, patched, before.Version); err != nil {
+			return err
+		}
+		if book, err = getBook(tx, id); err != nil {
+			return err
+		}
+		return recordAuditTx(tx, c, bookChangeEvent("book.updated", before, book))
+	})
+	if err != nil {
+		return bookProblem(err, "could not update book")
+	}
+
+	c.Set(fiber.HeaderETag, bookETag(book))
+	return c.JSON(newBookResponse(book))
+}
+
 // @Summary Delete book
-// @Description Delete book
+// @Description Move a book to the trash. With purge=true the book is removed permanently instead,
+// @Description whether it is in the trash or not (admin only).
 // @Tags books
 // @Produce  json
 // @Security ApiKeyAuth
+// @Security MachineKeyAuth
+// @x-required-role "editor"
+// @x-required-scope "books:write"
 // @Param bookID path int true "Book ID"
-// @Success 200 {object} map[string]string
-// @Failure 400 {string} string "Bad Request"
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 500 {string} string "Internal Server Error"
+// @Param If-Match header string true "ETag from GET /books/{bookID}, or * for any version"
+// @Param purge query bool false "Delete permanently (admin only)"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 404 {object} Problem "Not Found"
+// @Failure 412 {object} Problem "Precondition Failed"
+// @Failure 428 {object} Problem "Precondition Required"
+// @Failure 500 {object} Problem "Internal Server Error"
 // @Router /books/{bookID} [delete]
 func DeleteBook(c *fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.SendStatus(fiber.StatusBadRequest)
+		return newProblem(fiber.StatusBadRequest, "book id must be an integer")
+	}
+
+	purge := c.QueryBool("purge")
+	if purge && !hasRole(c, RoleAdmin) {
+		return newProblem(fiber.StatusForbidden, "admin role required to purge books")
+	}
+
+	version, err := requiredVersion(c)
+	if err != nil {
+		return err
+	}
+
+	err = gormdb.Transaction(func(tx *gorm.DB) error {
+		lookup := tx
+		if purge {
+			lookup = tx.Unscoped() // * a purge can empty the trash too
+		}
+		before, err := getBook(lookup, id)
+		if err != nil {
+			return err
+		}
+
+		action := "book.deleted"
+		if purge {
+			action = "book.purged"
+			err = purgeBook(tx, id, version)
+		} else {
+			err = deleteBook(tx, id, version)
+		}
+		if err != nil {
+			return err
+		}
+		return recordAuditTx(tx, c, bookChangeEvent(action, before, nil))
+	})
+	if err != nil {
+		return bookProblem(err, "could not delete book")
+	}
+
+	return c.JSON(MessageResponse{
+		Message: "Delete Book Successful",
+	})
+}
+
+// @Summary List trash
+// @Description List soft-deleted books, most recently deleted first (admin only).
+// @Description Books are purged automatically once they have been in the trash longer than TRASH_RETENTION.
+// @Tags books
+// @Produce  json
+// @Security ApiKeyAuth
+// @Security MachineKeyAuth
+// @x-required-role "admin"
+// @x-required-scope "books:read"
+// @Param page query int false "Page number, starting at 1" minimum(1) maximum(21474836) default(1)
+// @Param limit query int false "Items per page" minimum(1) maximum(100) default(20)
+// @Success 200 {object} TrashPage
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /books/trash [get]
+func GetTrash(c *fiber.Ctx) error {
+	page, limit, err := parsePageLimit(c)
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, err.Error())
 	}
 
-	err = deleteBook(gormdb, id)
+	books, total, err := getDeletedBooks(gormdb, page, limit)
 	if err != nil {
-		return c.SendStatus(fiber.StatusBadRequest)
+		return internalProblem("could not get trash", err)
+	}
+
+	result := TrashPage{
+		Items: newTrashedBookResponses(books),
+		Total: total,
+		Page:  page,
+		Limit: limit,
+	}
+	if int64(page*limit) < total {
+		result.Links.Next = pageLink(c, map[string]string{"page": strconv.Itoa(page + 1)})
 	}
+	if page > 1 {
+		result.Links.Prev = pageLink(c, map[string]string{"page": strconv.Itoa(page - 1)})
+	}
+
+	return c.JSON(result)
+}
 
-	return c.JSON(fiber.Map{
-		"message" : "Delete Book Successful",
+// @Summary Restore book
+// @Description Take a book out of the trash (admin only)
+// @Tags books
+// @Produce  json
+// @Security ApiKeyAuth
+// @Security MachineKeyAuth
+// @x-required-role "admin"
+// @x-required-scope "books:write"
+// @Param bookID path int true "Book ID"
+// @Success 200 {object} BookResponse
+// @Header 200 {string} ETag "New version of the book"
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 404 {object} Problem "Not Found"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /books/{bookID}/restore [post]
+func RestoreBook(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, "book id must be an integer")
+	}
+
+	var book *Book
+	err = gormdb.Transaction(func(tx *gorm.DB) error {
+		if err := restoreBook(tx, id, actorID(c)); err != nil {
+			return err
+		}
+		if book, err = getBook(tx, id); err != nil {
+			return err
+		}
+		return recordAuditTx(tx, c, bookChangeEvent("book.restored", nil, book))
 	})
+	if err != nil {
+		return bookProblem(err, "could not restore book")
+	}
+
+	c.Set(fiber.HeaderETag, bookETag(book))
+	return c.JSON(newBookResponse(book))
+}
+
+// @Summary JSON Web Key Set
+// @Description Public keys that verify our access tokens, for other services. Tokens carry the key id in their kid header.
+// @Description Empty when the server signs with the HS256 fallback secret.
+// @Tags auth
+// @Produce  json
+// @Success 200 {object} JWKSet
+// @Router /.well-known/jwks.json [get]
+func GetJWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age="+strconv.Itoa(int(jwksMaxAge/time.Second)))
+	return c.JSON(signingKeys.jwks())
 }
 
 // @Summary User register
-// @Description User register
+// @Description Create a user with the reader role and mail them a verification link (GET /email/verify).
+// @Description Unverified users can log in and read books, but can't change them.
 // @Tags auth
 // @Accept  json
 // @Produce  json
 // @Param User body UserDTO true "User DTO"
-// @Success 200 {object} map[string]string
-// @Failure 400 {string} string "Bad Request"
-// @Failure 500 {string} string "Internal Server Error"
+// @Success 201 {object} UserResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 409 {object} Problem "Conflict"
+// @Failure 500 {object} Problem "Internal Server Error"
 // @Router /register [post]
 func Register(c *fiber.Ctx) error {
-	user := new(User)
+	dto := new(UserDTO)
+
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
 
-	if err := c.BodyParser(user); err != nil {
-		return c.SendStatus(fiber.StatusBadRequest)
+	dto.Email = strings.TrimSpace(dto.Email)
+	if err := validateStruct(dto); err != nil {
+		return err
 	}
 
+	user := dto.toUser()
 	err := createUser(gormdb, user)
 
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return newProblem(fiber.StatusConflict, "email is already registered")
+	}
 	if err != nil {
-		return c.SendStatus(fiber.StatusBadRequest)
+		return internalProblem("could not register user", err)
 	}
-	
-	return c.JSON(fiber.Map{
-		"message" : "Register Successful",
-	})
+
+	if err := sendVerificationMail(user); err != nil {
+		return internalProblem("could not send verification email", err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(newUserResponse(user))
 }
 
 // @Summary User login
-// @Description Authenticate user and return JWT token
+// @Description Authenticate user and return a short-lived JWT access token (Token) and a refresh token.
+// @Description Trade the refresh token for a new pair at POST /token/refresh before the access token expires.
+// @Description Users with MFA get 202 and an mfa_token instead, finish the login at POST /login/mfa.
+// @Description After 5 failed logins an account is locked out for 1 minute, doubling with every further failure
+// @Description up to an hour (20 failures for a client IP), locked out logins get 429 with Retry-After.
+// @Description With ?mode=cookie a browser gets a session instead: HttpOnly session cookie, a SessionResponse with
+// @Description the CSRF token, and every request but GET/HEAD/OPTIONS must send it back in X-CSRF-Token.
 // @Tags auth
 // @Accept  json
 // @Produce  json
-// @Param User body UserDTO true "User DTO"
-// @Success 200 {object} map[string]string
-// @Failure 400 {string} string "Bad Request"
-// @Failure 500 {string} string "Internal Server Error"
+// @Param User body LoginDTO true "Login DTO"
+// @Param mode query string false "cookie for a browser session instead of tokens" Enums(cookie)
+// @Success 200 {object} TokenResponse "Tokens, or a SessionResponse with ?mode=cookie"
+// @Success 202 {object} MFAChallengeResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 429 {object} Problem "Too Many Requests"
+// @Failure 500 {object} Problem "Internal Server Error"
 // @Router /login [post]
 func LoginUser(c *fiber.Ctx) error {
-	var user User
+	credentials := new(LoginDTO)
+
+	if err := c.BodyParser(credentials); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
+
+	credentials.Email = strings.TrimSpace(credentials.Email)
+	if err := validateStruct(credentials); err != nil {
+		return err
+	}
 
-	if err := c.BodyParser(&user); err != nil {
-		return c.SendStatus(fiber.StatusBadRequest)
+	// * unknown emails are throttled like real ones, so lockouts don't tell which accounts exist
+	account := loginThrottle{key: accountThrottleKey(credentials.Email), free: accountFreeFailures}
+	ip := loginThrottle{key: ipThrottleKey(c.IP()), free: ipFreeFailures}
+	if err := checkThrottles(c, account, ip); err != nil {
+		return err
 	}
 
-	token, err := loginUser(gormdb, &user)
+	user, err := loginUser(gormdb, credentials)
 
+	if errors.Is(err, ErrInvalidCredentials) {
+		recordAudit(c, AuditEvent{Action: "login.failed", Subject: account.key, Details: map[string]interface{}{"method": "password"}})
+		if err := recordFailedLogin(c, account, ip); err != nil {
+			return err
+		}
+		return newProblem(fiber.StatusUnauthorized, err.Error())
+	}
+	if errors.Is(err, ErrAccountDisabled) || errors.Is(err, ErrPasswordResetRequired) {
+		recordAudit(c, AuditEvent{Action: "login.refused", Subject: account.key, Details: map[string]interface{}{"reason": err.Error()}})
+		return newProblem(fiber.StatusForbidden, err.Error())
+	}
+
+	var challenge *MFAChallenge
+	if err != nil && !errors.As(err, &challenge) {
+		return internalProblem("could not log in", err)
+	}
+
+	// * the password was right, whatever comes next
+	if err := resetLoginFailures(gormdb, account.key); err != nil {
+		return internalProblem("could not log in", err)
+	}
+
+	if challenge != nil {
+		return c.Status(fiber.StatusAccepted).JSON(MFAChallengeResponse{
+			Message:   "Enter the code from your authenticator app at POST /login/mfa",
+			MFAToken:  challenge.Token,
+			ExpiresIn: challenge.ExpiresIn,
+		})
+	}
+
+	return respondWithLogin(c, user, "password", false, cookieMode(c))
+}
+
+// @Summary Refresh tokens
+// @Description Trade a refresh token for a new access token and refresh token. Each refresh token works once;
+// @Description presenting one that was already used revokes every token of that login.
+// @Tags auth
+// @Accept  json
+// @Produce  json
+// @Param Refresh body RefreshDTO true "Refresh DTO"
+// @Success 200 {object} TokenResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /token/refresh [post]
+func RefreshTokens(c *fiber.Ctx) error {
+	dto := new(RefreshDTO)
+
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
+
+	tokens, err := rotateRefreshToken(gormdb, dto.RefreshToken, "")
+	if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+		return newProblem(fiber.StatusUnauthorized, err.Error())
+	}
+	if errors.Is(err, ErrAccountDisabled) {
+		return newProblem(fiber.StatusForbidden, err.Error())
+	}
 	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
+		return internalProblem("could not refresh token", err)
 	}
+	recordTokenRefresh(c, tokens, "")
 
-	// ! Doesn't work with swagger
-	// c.Cookie(&fiber.Cookie{
-	// 	Name:     "jwt",
-	// 	Value:    token,
-	// 	Expires:  time.Now().Add(time.Hour * 72),
-	// 	HTTPOnly: true,
-	// })
+	return c.JSON(newTokenResponse("Refresh successful", tokens))
+}
+
+// @Summary Logout
+// @Description Revoke the access token used for this request and every refresh token of the same login,
+// @Description or end the session and clear its cookies in cookie mode
+// @Tags auth
+// @Produce  json
+// @Security ApiKeyAuth
+// @Success 200 {object} MessageResponse
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /logout [post]
+func Logout(c *fiber.Ctx) error {
+	principal := currentPrincipal(c)
 
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"message" : "Login successful",
-		"Token" : token,
-	})	
-}
\ No newline at end of file
+	if principal.CookieSessionID != 0 {
+		if err := revokeSession(gormdb, principal.CookieSessionID); err != nil {
+			return internalProblem("could not log out", err)
+		}
+		clearSessionCookies(c)
+		return c.JSON(MessageResponse{
+			Message: "Logout successful",
+		})
+	}
+
+	if err := revokeAccessToken(gormdb, principal.TokenID, principal.ExpiresAt); err != nil {
+		return internalProblem("could not log out", err)
+	}
+	if err := revokeTokenFamily(gormdb, principal.SessionID); err != nil {
+		return internalProblem("could not log out", err)
+	}
+
+	return c.JSON(MessageResponse{
+		Message: "Logout successful",
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// * testDB connects to TEST_DATABASE_URL, a throwaway Postgres database, tests that need one skip without it.
+// * The README has how to run them, everything else runs with a plain go test.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("set TEST_DATABASE_URL to run the tests that need Postgres")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+		Logger:         logger.Default.LogMode(logger.Silent),
+		TranslateError: true,
+	})
+	if err != nil {
+		t.Fatalf("connect to the test database: %v", err)
+	}
+	err = db.AutoMigrate(&User{}, &RefreshToken{}, &RevokedToken{}, &PasswordResetToken{}, &MFARecoveryCode{}, &LoginThrottle{}, &UserIdentity{}, &OIDCLoginState{}, &OAuthClient{}, &OAuthAuthorizationCode{}, &Session{}, &AuditEntry{})
+	if err != nil {
+		t.Fatalf("migrate the test database: %v", err)
+	}
+	if err := migrateUserEmailIndex(db); err != nil {
+		t.Fatalf("migrate the user email index: %v", err)
+	}
+
+	cfg := defaultConfig()
+	cfg.JWT.SecretKey = "test-secret"
+	cfg.apply()
+	if err := setupSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := gormdb
+	gormdb = db
+	t.Cleanup(func() { gormdb = previous })
+	return db
+}
+
+// * testEmail is an address no other test run has used, the test database is never cleaned up
+func testEmail(t *testing.T) string {
+	return fmt.Sprintf("%s-%d@example.com", strings.ToLower(t.Name()), time.Now().UnixNano())
+}
+
+func testRequest(t *testing.T, app *fiber.App, req *http.Request) *http.Response {
+	t.Helper()
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func expectStatus(t *testing.T, resp *http.Response, want int) {
+	t.Helper()
+	if resp.StatusCode != want {
+		var problem Problem
+		json.NewDecoder(resp.Body).Decode(&problem)
+		t.Fatalf("got %d (%s), want %d", resp.StatusCode, problem.Detail, want)
+	}
+}
+
+func createTestUser(t *testing.T, db *gorm.DB, email string) *User {
+	t.Helper()
+	user := &User{Email: email, Password: "Password123"}
+	if err := createUser(db, user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// * currentUser loads the caller's user row, for the /me endpoints
+func currentUser(c *fiber.Ctx) (*User, error) {
+	user, err := getUser(gormdb, int(currentUserID(c)))
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, newProblem(fiber.StatusUnauthorized, "user no longer exists")
+	}
+	if err != nil {
+		return nil, internalProblem("could not get user", err)
+	}
+	return user, nil
+}
+
+// * accountProblem maps the errors of the account functions to the matching problem
+func accountProblem(err error, detail string) error {
+	switch {
+	case errors.Is(err, ErrWrongPassword):
+		return newProblem(fiber.StatusForbidden, err.Error())
+	case errors.Is(err, ErrEmailTaken), errors.Is(err, gorm.ErrDuplicatedKey):
+		return newProblem(fiber.StatusConflict, ErrEmailTaken.Error())
+	case errors.Is(err, ErrVerificationTooSoon):
+		return newProblem(fiber.StatusTooManyRequests, err.Error())
+	default:
+		return userProblem(err, detail)
+	}
+}
+
+// @Summary Get my profile
+// @Description The logged in user
+// @Tags me
+// @Produce  json
+// @Security ApiKeyAuth
+// @Success 200 {object} UserResponse
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /me [get]
+func GetMe(c *fiber.Ctx) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(newUserResponse(user))
+}
+
+// @Summary Update my profile
+// @Description Change display_name, avatar_url (http or https) and locale (BCP 47, e.g. en-US).
+// @Description application/merge-patch+json (RFC 7396) or application/json-patch+json (RFC 6902), like PATCH /books/{bookID}.
+// @Tags me
+// @Accept application/merge-patch+json
+// @Accept application/json-patch+json
+// @Accept json
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param Patch body object true "Merge patch object or JSON patch operation array"
+// @Success 200 {object} UserResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 415 {object} Problem "Unsupported Media Type"
+// @Failure 422 {object} Problem "Unprocessable Entity"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /me [patch]
+func PatchMe(c *fiber.Ctx) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	dto := new(ProfileDTO)
+	if err := applyPatch(newProfileDTO(user), c.Get(fiber.HeaderContentType), c.Body(), dto); err != nil {
+		return err
+	}
+
+	dto.DisplayName = strings.TrimSpace(dto.DisplayName)
+	dto.AvatarURL = strings.TrimSpace(dto.AvatarURL)
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
+
+	if err := updateProfile(gormdb, user.ID, dto); err != nil {
+		return userProblem(err, "could not update profile")
+	}
+
+	user, err = currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(newUserResponse(user))
+}
+
+// @Summary Change my password
+// @Description Set a new password, it needs the current one. Every other login of the user is logged out.
+// @Tags me
+// @Accept  json
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param Password body ChangePasswordDTO true "Change password DTO"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /me/password [put]
+func ChangePassword(c *fiber.Ctx) error {
+	dto := new(ChangePasswordDTO)
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	if err := changePassword(gormdb, user, dto, currentPrincipal(c).SessionID, currentPrincipal(c).CookieSessionID); err != nil {
+		return accountProblem(err, "could not change password")
+	}
+
+	return c.JSON(MessageResponse{
+		Message: "Password changed",
+	})
+}
+
+// @Summary Change my email
+// @Description Request a new email, it needs the password. The new email gets a verification link and replaces
+// @Description the current one once the link is opened, until then the current email keeps working.
+// @Tags me
+// @Accept  json
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param Email body ChangeEmailDTO true "Change email DTO"
+// @Success 202 {object} UserResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 409 {object} Problem "Conflict"
+// @Failure 429 {object} Problem "Too Many Requests"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /me/email [put]
+func ChangeEmail(c *fiber.Ctx) error {
+	dto := new(ChangeEmailDTO)
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
+
+	dto.Email = strings.TrimSpace(dto.Email)
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+	if dto.Email == user.Email {
+		return newProblem(fiber.StatusConflict, "that is already your email")
+	}
+
+	if err := requestEmailChange(gormdb, user, dto); err != nil {
+		return accountProblem(err, "could not change email")
+	}
+	if err := sendVerificationMail(user); err != nil {
+		return accountProblem(err, "could not send verification email")
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(newUserResponse(user))
+}
+
+// @Summary Delete my account
+// @Description Delete the logged in user, it needs the password. Every login of the user is logged out
+// @Description and the email can register again.
+// @Tags me
+// @Accept  json
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param Account body DeleteAccountDTO true "Delete account DTO"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /me [delete]
+func DeleteMe(c *fiber.Ctx) error {
+	dto := new(DeleteAccountDTO)
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	if err := deleteAccount(gormdb, user, dto.Password); err != nil {
+		return accountProblem(err, "could not delete account")
+	}
+
+	recordAudit(c, AuditEvent{Action: "user.deleted", Subject: "user:" + strconv.FormatUint(uint64(user.ID), 10)})
+
+	return c.JSON(MessageResponse{
+		Message: "Account deleted",
+	})
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// * mfaProblem maps the errors of the MFA model functions to the matching problem
+func mfaProblem(err error, detail string) error {
+	switch {
+	case errors.Is(err, ErrInvalidMFACode), errors.Is(err, ErrInvalidMFAChallenge):
+		return newProblem(fiber.StatusUnauthorized, err.Error())
+	case errors.Is(err, ErrMFAAlreadyEnabled), errors.Is(err, ErrMFANotEnabled), errors.Is(err, ErrMFANotEnrolled):
+		return newProblem(fiber.StatusConflict, err.Error())
+	case errors.Is(err, ErrAccountDisabled):
+		return newProblem(fiber.StatusForbidden, err.Error())
+	default:
+		return internalProblem(detail, err)
+	}
+}
+
+// @Summary Start TOTP enrollment
+// @Description Create a new TOTP secret (RFC 6238, SHA1, 6 digits, 30 seconds) for the logged in user.
+// @Description Scan qr_code or add provisioning_uri to an authenticator app, then confirm with POST /me/mfa/totp/confirm.
+// @Description Calling it again before confirming replaces the secret.
+// @Tags mfa
+// @Produce  json
+// @Security ApiKeyAuth
+// @Success 200 {object} TOTPEnrollment
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 409 {object} Problem "Conflict"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /me/mfa/totp [post]
+func EnrollTOTP(c *fiber.Ctx) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	enrollment, err := startTOTPEnrollment(gormdb, user)
+	if err != nil {
+		return mfaProblem(err, "could not start TOTP enrollment")
+	}
+
+	return c.JSON(enrollment)
+}
+
+// @Summary Confirm TOTP enrollment
+// @Description Turn MFA on with a code from the authenticator app. The response has the recovery codes,
+// @Description they are shown only this once and each works once in place of a TOTP code.
+// @Description Log in again afterwards to get a token that counts as MFA.
+// @Tags mfa
+// @Accept  json
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param Code body MFACodeDTO true "TOTP code"
+// @Success 200 {object} RecoveryCodesResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 409 {object} Problem "Conflict"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /me/mfa/totp/confirm [post]
+func ConfirmTOTP(c *fiber.Ctx) error {
+	dto := new(MFACodeDTO)
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	codes, err := confirmTOTP(gormdb, user, dto.Code)
+	if err != nil {
+		return mfaProblem(err, "could not confirm TOTP")
+	}
+
+	return c.JSON(RecoveryCodesResponse{
+		Message:       "MFA enabled, store the recovery codes somewhere safe",
+		RecoveryCodes: codes,
+	})
+}
+
+// @Summary Disable MFA
+// @Description Turn MFA off, it takes a current TOTP code or a recovery code. The recovery codes are deleted.
+// @Tags mfa
+// @Accept  json
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param Code body MFACodeDTO true "TOTP or recovery code"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 409 {object} Problem "Conflict"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /me/mfa/totp [delete]
+func DisableMFA(c *fiber.Ctx) error {
+	dto := new(MFACodeDTO)
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	if err := disableMFA(gormdb, user, dto.Code); err != nil {
+		return mfaProblem(err, "could not disable MFA")
+	}
+
+	return c.JSON(MessageResponse{
+		Message: "MFA disabled",
+	})
+}
+
+// @Summary Login MFA step
+// @Description Second step of a login for users with MFA: trade the mfa_token from POST /login and a TOTP
+// @Description or recovery code for the tokens. An mfa_token works once and expires after 5 minutes.
+// @Description With ?mode=cookie the response is a SessionResponse and sets the session cookies instead.
+// @Tags auth
+// @Accept  json
+// @Produce  json
+// @Param MFA body MFALoginDTO true "MFA login DTO"
+// @Param mode query string false "cookie for a browser session instead of tokens" Enums(cookie)
+// @Success 200 {object} TokenResponse "Tokens, or a SessionResponse with ?mode=cookie"
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 429 {object} Problem "Too Many Requests"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /login/mfa [post]
+func LoginMFA(c *fiber.Ctx) error {
+	dto := new(MFALoginDTO)
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
+
+	claims, err := parseMFAChallenge(dto.MFAToken)
+	if err != nil {
+		return mfaProblem(err, "could not log in")
+	}
+
+	// * 6 digits are quick to guess, so codes are throttled like passwords
+	account := loginThrottle{key: "mfa:" + strconv.FormatUint(uint64(claims.UserID), 10), free: accountFreeFailures}
+	ip := loginThrottle{key: ipThrottleKey(c.IP()), free: ipFreeFailures}
+	if err := checkThrottles(c, account, ip); err != nil {
+		return err
+	}
+
+	user, err := completeMFALogin(gormdb, claims, dto.Code)
+	if errors.Is(err, ErrInvalidMFACode) {
+		recordAudit(c, AuditEvent{
+			Action:  "login.failed",
+			Subject: userSubject(int(claims.UserID)),
+			Details: map[string]interface{}{"method": "mfa"},
+		})
+		if err := recordFailedLogin(c, account, ip); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return mfaProblem(err, "could not log in")
+	}
+	if err := resetLoginFailures(gormdb, account.key); err != nil {
+		return internalProblem("could not log in", err)
+	}
+
+	return respondWithLogin(c, user, "mfa", true, cookieMode(c))
+}
+
+// @Summary Get MFA policy
+// @Description Roles whose routes need a token from a login with MFA
+// @Tags settings
+// @Produce  json
+// @Security ApiKeyAuth
+// @x-required-role "admin"
+// @Success 200 {object} MFAPolicyResponse
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Router /settings/mfa [get]
+func GetMFAPolicy(c *fiber.Ctx) error {
+	return c.JSON(MFAPolicyResponse{RequiredRoles: mfaPolicy.list()})
+}
+
+// @Summary Update MFA policy
+// @Description Require MFA for users of the given roles, e.g. ["editor","admin"]. Users with such a role and
+// @Description no MFA can still log in and enroll under /me, but get 403 on every route that needs a role.
+// @Tags settings
+// @Accept  json
+// @Produce  json
+// @Security ApiKeyAuth
+// @x-required-role "admin"
+// @Param Policy body MFAPolicyDTO true "MFA policy DTO"
+// @Success 200 {object} MFAPolicyResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /settings/mfa [put]
+func UpdateMFAPolicy(c *fiber.Ctx) error {
+	dto := new(MFAPolicyDTO)
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
+
+	if err := updateMFAPolicy(gormdb, dto.RequiredRoles, actorID(c)); err != nil {
+		return internalProblem("could not update MFA policy", err)
+	}
+
+	return c.JSON(MFAPolicyResponse{RequiredRoles: mfaPolicy.list()})
+}
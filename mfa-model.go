@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"image/png"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"gorm.io/gorm"
+)
+
+const (
+	totpIssuer           = "Book API" // * the name authenticator apps show next to the code
+	totpPeriod           = 30         // * seconds
+	recoveryCodeCount    = 10
+	mfaChallengeTTL      = 5 * time.Minute
+	mfaChallengeAudience = "mfa" // * keeps challenge tokens from passing as access tokens
+)
+
+// * MFARecoveryCode is a single-use code for when the authenticator is lost, only its sha256 is stored
+type MFARecoveryCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index;not null"`
+	CodeHash  string `gorm:"uniqueIndex;not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// * MFAChallengeClaims is the token the password step of a login returns when the user has MFA
+type MFAChallengeClaims struct {
+	jwt.RegisteredClaims
+	UserID uint `json:"user_id"`
+}
+
+type TOTPEnrollment struct {
+	Secret          string `json:"secret" example:"JBSWY3DPEHPK3PXP"`
+	ProvisioningURI string `json:"provisioning_uri" example:"otpauth://totp/Book%20API:user@example.com?issuer=Book%20API&secret=JBSWY3DPEHPK3PXP"`
+	QRCode          string `json:"qr_code" example:"data:image/png;base64,iVBORw0KGgo..."` // * the provisioning URI as a PNG
+}
+
+type MFACodeDTO struct {
+	Code string `json:"code" validate:"required,max=20" example:"123456"` // * a TOTP code or a recovery code
+}
+
+type MFALoginDTO struct {
+	MFAToken string `json:"mfa_token" validate:"required" example:"eyJhbGciOiJSUzI1NiIsImtpZCI6..."`
+	Code     string `json:"code" validate:"required,max=20" example:"123456"` // * a TOTP code or a recovery code
+}
+
+type RecoveryCodesResponse struct {
+	Message       string   `json:"message" example:"MFA enabled, store the recovery codes somewhere safe"`
+	RecoveryCodes []string `json:"recovery_codes" example:"k7wq-m2xa,p9rd-4hzt"`
+}
+
+type MFAChallengeResponse struct {
+	Message   string `json:"message" example:"Enter the code from your authenticator app"`
+	MFAToken  string `json:"mfa_token" example:"eyJhbGciOiJSUzI1NiIsImtpZCI6..."`
+	ExpiresIn int64  `json:"expires_in" example:"300"` // * seconds until mfa_token expires
+}
+
+var (
+	ErrMFANotEnrolled      = errors.New("start the TOTP enrollment first")
+	ErrMFAAlreadyEnabled   = errors.New("MFA is already enabled")
+	ErrMFANotEnabled       = errors.New("MFA is not enabled")
+	ErrInvalidMFACode      = errors.New("invalid code")
+	ErrInvalidMFAChallenge = errors.New("invalid or expired MFA token")
+)
+
+// * MFAChallenge is returned by loginUser instead of tokens when the password was right but a second factor is due
+type MFAChallenge struct {
+	Token     string
+	ExpiresIn int64
+}
+
+func (ch *MFAChallenge) Error() string {
+	return "MFA code required"
+}
+
+func newMFAChallenge(user *User) (*MFAChallenge, error) {
+	now := time.Now()
+	token, err := signingKeys.sign(&MFAChallengeClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Audience:  jwt.ClaimStrings{mfaChallengeAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(mfaChallengeTTL)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        uuid.NewString(),
+		},
+		UserID: user.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MFAChallenge{Token: token, ExpiresIn: int64(mfaChallengeTTL / time.Second)}, nil
+}
+
+func parseMFAChallenge(tokenStr string) (*MFAChallengeClaims, error) {
+	claims := new(MFAChallengeClaims)
+	token, err := signingKeys.parse(tokenStr, claims)
+	if err != nil || !token.Valid || claims.ExpiresAt == nil || claims.ID == "" ||
+		!claims.VerifyIssuer(jwtIssuer, true) || !claims.VerifyAudience(mfaChallengeAudience, true) {
+		return nil, ErrInvalidMFAChallenge
+	}
+	return claims, nil
+}
+
+// * startTOTPEnrollment gives the user a new secret, it only counts once confirmTOTP saw a code from it
+func startTOTPEnrollment(db *gorm.DB, user *User) (*TOTPEnrollment, error) {
+	if user.MFAEnabledAt != nil {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: user.Email,
+		Period:      totpPeriod,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := key.Image(256, 256)
+	if err != nil {
+		return nil, err
+	}
+	var qr bytes.Buffer
+	if err := png.Encode(&qr, img); err != nil {
+		return nil, err
+	}
+
+	result := db.Model(&User{}).Where("id = ? AND mfa_enabled_at IS NULL", user.ID).
+		Updates(map[string]interface{}{"totp_secret": key.Secret(), "totp_last_step": 0})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	return &TOTPEnrollment{
+		Secret:          key.Secret(),
+		ProvisioningURI: key.URL(),
+		QRCode:          "data:image/png;base64," + base64.StdEncoding.EncodeToString(qr.Bytes()),
+	}, nil
+}
+
+// * useTOTPCode accepts the code of the current period or one period either side (clock drift).
+// * A code is taken at most once, the step it was generated for is remembered.
+func useTOTPCode(db *gorm.DB, user *User, code string) error {
+	if user.TOTPSecret == "" {
+		return ErrMFANotEnrolled
+	}
+
+	now := time.Now()
+	for _, skew := range []int64{0, -1, 1} {
+		at := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCodeCustom(user.TOTPSecret, at, totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) != 1 {
+			continue
+		}
+
+		step := at.Unix() / totpPeriod
+		result := db.Model(&User{}).Where("id = ? AND totp_last_step < ?", user.ID, step).
+			Update("totp_last_step", step)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidMFACode // * replayed
+		}
+		return nil
+	}
+
+	return ErrInvalidMFACode
+}
+
+func newRecoveryCode() (string, error) {
+	buf := make([]byte, 5)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(buf)) // * 8 characters
+	return code[:4] + "-" + code[4:], nil
+}
+
+// * normalizeRecoveryCode lets users type codes without the dash or in capitals
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// * useRecoveryCode burns one of the user's recovery codes
+func useRecoveryCode(db *gorm.DB, user *User, code string) error {
+	result := db.Model(&MFARecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashToken(normalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// * verifyMFACode takes a TOTP code or, failing that, a recovery code
+func verifyMFACode(db *gorm.DB, user *User, code string) error {
+	err := useTOTPCode(db, user, strings.TrimSpace(code))
+	if errors.Is(err, ErrInvalidMFACode) {
+		return useRecoveryCode(db, user, code)
+	}
+	return err
+}
+
+// * confirmTOTP turns MFA on once the user proved their app works, it returns the new recovery codes in plain
+// * text, this is the only time they are shown
+func confirmTOTP(db *gorm.DB, user *User, code string) ([]string, error) {
+	if user.MFAEnabledAt != nil {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if err := useTOTPCode(db, user, strings.TrimSpace(code)); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	rows := make([]MFARecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		rows[i] = MFARecoveryCode{UserID: user.ID, CodeHash: hashToken(code)}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&MFARecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&rows).Error; err != nil {
+			return err
+		}
+		return tx.Model(&User{}).Where("id = ?", user.ID).Update("mfa_enabled_at", time.Now()).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// * disableMFA needs a current code, so a stolen access token alone can't turn MFA off
+func disableMFA(db *gorm.DB, user *User, code string) error {
+	if user.MFAEnabledAt == nil {
+		return ErrMFANotEnabled
+	}
+	if err := verifyMFACode(db, user, code); err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&MFARecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+			"mfa_enabled_at": nil,
+			"totp_secret":    "",
+			"totp_last_step": 0,
+		}).Error
+	})
+}
+
+// * completeMFALogin is the second step of a login, the challenge token works once
+func completeMFALogin(db *gorm.DB, claims *MFAChallengeClaims, code string) (*User, error) {
+	revoked, err := tokenRevoked(db, claims.ID, "")
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrInvalidMFAChallenge
+	}
+
+	user, err := getUser(db, int(claims.UserID))
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.MFAEnabledAt == nil {
+		return nil, ErrInvalidMFAChallenge
+	}
+
+	if err := verifyMFACode(db, user, code); err != nil {
+		return nil, err
+	}
+	// * the deny list's primary key makes sure only one request gets tokens out of a challenge
+	err = revokeAccessToken(db, claims.ID, claims.ExpiresAt.Time)
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// * oauthClientProblem maps the errors of the OAuth client functions to the matching problem,
+// * for the endpoints our own users call. The endpoints apps call answer with OAuthError.
+func oauthClientProblem(err error, detail string) error {
+	switch {
+	case errors.Is(err, ErrOAuthClientNotFound):
+		return newProblem(fiber.StatusNotFound, err.Error())
+	case errors.Is(err, ErrInvalidOAuthClient), errors.Is(err, ErrInvalidRedirectURI), errors.Is(err, ErrInvalidOAuthScope):
+		return newProblem(fiber.StatusBadRequest, err.Error())
+	default:
+		return internalProblem(detail, err)
+	}
+}
+
+// * oauthError answers like RFC 6749 section 5.2
+func oauthError(c *fiber.Ctx, status int, code, description string) error {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Status(status).JSON(OAuthError{Error: code, ErrorDescription: description})
+}
+
+func basicAuth(header string) (string, string, bool) {
+	encoded, ok := strings.CutPrefix(header, "Basic ")
+	if !ok {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", false
+	}
+	// * oauth2 clients url-encode both halves before joining them (RFC 6749 2.3.1)
+	user, _ = url.QueryUnescape(user)
+	pass, _ = url.QueryUnescape(pass)
+	return user, pass, true
+}
+
+// * callingClient authenticates the app with HTTP Basic or client_id/client_secret form fields,
+// * it answers the request itself (invalid_client) when that fails
+func callingClient(c *fiber.Ctx) (*OAuthClient, error) {
+	id, secret := c.FormValue("client_id"), c.FormValue("client_secret")
+	if user, pass, ok := basicAuth(c.Get(fiber.HeaderAuthorization)); ok {
+		id, secret = user, pass
+	}
+
+	client, err := authenticateOAuthClient(gormdb, id, secret)
+	if errors.Is(err, ErrInvalidOAuthClient) {
+		c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="oauth"`)
+		return nil, oauthError(c, fiber.StatusUnauthorized, "invalid_client", err.Error())
+	}
+	if err != nil {
+		return nil, internalProblem("could not check client", err)
+	}
+	return client, nil
+}
+
+// @Summary Register OAuth client
+// @Description Register a third-party app (admin only). Confidential clients get a client secret, it is only shown
+// @Description in this response. Public clients (mobile apps, SPAs) have none and can only use the authorization
+// @Description code grant with PKCE.
+// @Tags oauth
+// @Accept  json
+// @Produce  json
+// @Security ApiKeyAuth
+// @x-required-role "admin"
+// @Param Client body OAuthClientDTO true "OAuth client DTO"
+// @Success 201 {object} CreatedOAuthClientResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /oauth/clients [post]
+func CreateOAuthClient(c *fiber.Ctx) error {
+	dto := new(OAuthClientDTO)
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
+	if !dto.Confidential && len(dto.RedirectURIs) == 0 {
+		return newProblem(fiber.StatusBadRequest, "public clients need at least one redirect URI")
+	}
+
+	client, secret, err := createOAuthClient(gormdb, dto, actorID(c))
+	if err != nil {
+		return internalProblem("could not create OAuth client", err)
+	}
+	recordAudit(c, AuditEvent{
+		Action:  "oauth_client.created",
+		Subject: "oauth_client:" + client.ClientID,
+		Details: map[string]interface{}{"name": client.Name, "scopes": client.Scopes},
+	})
+
+	return c.Status(fiber.StatusCreated).JSON(CreatedOAuthClientResponse{
+		OAuthClientResponse: newOAuthClientResponse(client),
+		ClientSecret:        secret,
+	})
+}
+
+// @Summary List OAuth clients
+// @Description Every registered third-party app, revoked ones included (admin only)
+// @Tags oauth
+// @Produce  json
+// @Security ApiKeyAuth
+// @x-required-role "admin"
+// @Success 200 {array} OAuthClientResponse
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /oauth/clients [get]
+func GetOAuthClients(c *fiber.Ctx) error {
+	clients, err := getOAuthClients(gormdb)
+	if err != nil {
+		return internalProblem("could not get OAuth clients", err)
+	}
+
+	return c.JSON(newOAuthClientResponses(clients))
+}
+
+// @Summary Revoke OAuth client
+// @Description Revoke a third-party app (admin only), every token it holds stops working at once
+// @Tags oauth
+// @Produce  json
+// @Security ApiKeyAuth
+// @x-required-role "admin"
+// @Param id path int true "OAuth client ID"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 404 {object} Problem "Not Found"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /oauth/clients/{id} [delete]
+func RevokeOAuthClient(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, "OAuth client id must be an integer")
+	}
+
+	client, err := revokeOAuthClient(gormdb, id)
+	if err != nil {
+		return oauthClientProblem(err, "could not revoke OAuth client")
+	}
+	recordAudit(c, AuditEvent{
+		Action:  "oauth_client.revoked",
+		Subject: "oauth_client:" + client.ClientID,
+	})
+
+	return c.JSON(MessageResponse{
+		Message: "OAuth client revoked",
+	})
+}
+
+// @Summary Authorize OAuth client
+// @Description The consent step of the authorization code grant. The app sends the user to our frontend with the
+// @Description parameters below, once the user agrees the frontend posts them here and sends the browser on to
+// @Description redirect_to, which carries the code (valid for a minute) and the app's state. PKCE (S256) is required.
+// @Description The app gets at most the scopes it was registered with and the user's role has.
+// @Tags oauth
+// @Accept  json
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param Authorize body AuthorizeDTO true "Authorization request"
+// @Success 200 {object} AuthorizeResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /oauth/authorize [post]
+func AuthorizeOAuthClient(c *fiber.Ctx) error {
+	dto := new(AuthorizeDTO)
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	code, err := authorizeOAuthClient(gormdb, user, dto, currentPrincipal(c).MFA)
+	if err != nil {
+		return oauthClientProblem(err, "could not authorize OAuth client")
+	}
+
+	redirect, err := url.Parse(dto.RedirectURI)
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, ErrInvalidRedirectURI.Error())
+	}
+	query := redirect.Query()
+	query.Set("code", code)
+	if dto.State != "" {
+		query.Set("state", dto.State)
+	}
+	redirect.RawQuery = query.Encode()
+
+	return c.JSON(AuthorizeResponse{RedirectTo: redirect.String()})
+}
+
+// @Summary OAuth token endpoint
+// @Description Grants for third-party apps (RFC 6749): authorization_code (with code, redirect_uri and the PKCE
+// @Description code_verifier), refresh_token, and client_credentials for confidential clients acting as themselves.
+// @Description Clients authenticate with HTTP Basic or client_id/client_secret, public clients only send client_id.
+// @Description The access tokens only work for the /books endpoints, within their scope. Errors are RFC 6749 errors.
+// @Tags oauth
+// @Accept  x-www-form-urlencoded
+// @Produce  json
+// @Security OAuthClientAuth
+// @Param grant_type formData string true "Grant type" Enums(authorization_code, refresh_token, client_credentials)
+// @Param code formData string false "Authorization code (authorization_code)"
+// @Param redirect_uri formData string false "Redirect URI the code was issued for (authorization_code)"
+// @Param code_verifier formData string false "PKCE code verifier (authorization_code)"
+// @Param refresh_token formData string false "Refresh token (refresh_token)"
+// @Param scope formData string false "Space separated scopes (client_credentials)"
+// @Param client_id formData string false "Client ID, when not using HTTP Basic"
+// @Param client_secret formData string false "Client secret, when not using HTTP Basic"
+// @Success 200 {object} OAuthTokenResponse
+// @Failure 400 {object} OAuthError "Bad Request"
+// @Failure 401 {object} OAuthError "Unauthorized"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /oauth/token [post]
+func OAuthToken(c *fiber.Ctx) error {
+	client, err := callingClient(c)
+	if client == nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	switch c.FormValue("grant_type") {
+	case "authorization_code":
+		tokens, err := exchangeAuthorizationCode(gormdb, client,
+			c.FormValue("code"), c.FormValue("redirect_uri"), c.FormValue("code_verifier"))
+		if errors.Is(err, ErrInvalidOAuthGrant) || errors.Is(err, ErrAccountDisabled) {
+			return oauthError(c, fiber.StatusBadRequest, "invalid_grant", err.Error())
+		}
+		if err != nil {
+			return internalProblem("could not issue tokens", err)
+		}
+		return c.JSON(newOAuthTokenResponse(tokens))
+
+	case "refresh_token":
+		tokens, err := rotateRefreshToken(gormdb, c.FormValue("refresh_token"), client.ClientID)
+		if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) || errors.Is(err, ErrAccountDisabled) {
+			return oauthError(c, fiber.StatusBadRequest, "invalid_grant", err.Error())
+		}
+		if err != nil {
+			return internalProblem("could not refresh tokens", err)
+		}
+		recordTokenRefresh(c, tokens, client.ClientID)
+		return c.JSON(newOAuthTokenResponse(tokens))
+
+	case "client_credentials":
+		token, scope, err := issueClientToken(client, c.FormValue("scope"))
+		if errors.Is(err, ErrUnauthorizedClient) {
+			return oauthError(c, fiber.StatusBadRequest, "unauthorized_client", err.Error())
+		}
+		if errors.Is(err, ErrInvalidOAuthScope) {
+			return oauthError(c, fiber.StatusBadRequest, "invalid_scope", err.Error())
+		}
+		if err != nil {
+			return internalProblem("could not issue token", err)
+		}
+		return c.JSON(newOAuthTokenResponse(&TokenPair{
+			AccessToken: token,
+			ExpiresIn:   int64(accessTokenTTL / time.Second),
+			Scope:       scope,
+		}))
+
+	default:
+		return oauthError(c, fiber.StatusBadRequest, "unsupported_grant_type",
+			"use authorization_code, refresh_token or client_credentials")
+	}
+}
+
+// @Summary OAuth token introspection
+// @Description RFC 7662: whether a token the calling client holds is still active, and its scope. Tokens of
+// @Description other clients are reported as inactive.
+// @Tags oauth
+// @Accept  x-www-form-urlencoded
+// @Produce  json
+// @Security OAuthClientAuth
+// @Param token formData string true "Access token or refresh token"
+// @Success 200 {object} IntrospectionResponse
+// @Failure 401 {object} OAuthError "Unauthorized"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /oauth/introspect [post]
+func IntrospectOAuthToken(c *fiber.Ctx) error {
+	client, err := callingClient(c)
+	if client == nil {
+		return err
+	}
+
+	response, err := introspectOAuthToken(gormdb, client, c.FormValue("token"))
+	if err != nil {
+		return internalProblem("could not introspect token", err)
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(response)
+}
+
+// @Summary OAuth token revocation
+// @Description RFC 7009: revoke an access token or a refresh token of the calling client. Revoking a refresh token
+// @Description also ends the access tokens issued with it. Unknown tokens are answered with 200 as well.
+// @Tags oauth
+// @Accept  x-www-form-urlencoded
+// @Security OAuthClientAuth
+// @Param token formData string true "Access token or refresh token"
+// @Success 200
+// @Failure 401 {object} OAuthError "Unauthorized"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /oauth/revoke [post]
+func RevokeOAuthToken(c *fiber.Ctx) error {
+	client, err := callingClient(c)
+	if client == nil {
+		return err
+	}
+
+	if err := revokeOAuthToken(gormdb, client, c.FormValue("token")); err != nil {
+		return internalProblem("could not revoke token", err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
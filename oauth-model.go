@@ -0,0 +1,486 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	oauthClientPrefix = "oc_"
+	oauthCodeTTL      = time.Minute // * the app trades the code right away, RFC 6749 recommends at most 10 minutes
+)
+
+// * OAuthClient is a third-party app registered by an admin. Confidential clients (servers) have a secret,
+// * public clients (mobile, SPA) only have PKCE and can't use client credentials.
+type OAuthClient struct {
+	ID           uint   `gorm:"primaryKey"`
+	ClientID     string `gorm:"uniqueIndex;not null"`
+	SecretHash   string // * sha256 of the secret, empty for public clients
+	Name         string `gorm:"not null"`
+	RedirectURIs string `gorm:"not null"` // * space separated, a redirect_uri must match one exactly
+	Scopes       string `gorm:"not null"` // * space separated, the most the app can ever get
+	CreatedBy    *uint
+	RevokedAt    *time.Time
+	CreatedAt    time.Time
+}
+
+func (OAuthClient) TableName() string {
+	return "oauth_clients"
+}
+
+// * OAuthAuthorizationCode is a user's consent waiting to be traded at POST /oauth/token, it works once
+type OAuthAuthorizationCode struct {
+	CodeHash      string    `gorm:"primaryKey"`
+	ClientID      string    `gorm:"not null"`
+	UserID        uint      `gorm:"not null"`
+	RedirectURI   string    `gorm:"not null"`
+	Scope         string    `gorm:"not null"`
+	CodeChallenge string    `gorm:"not null"`               // * S256 PKCE challenge
+	MFA           bool      `gorm:"not null;default:false"` // * the consenting user's login passed a second factor
+	ExpiresAt     time.Time `gorm:"index"`
+	CreatedAt     time.Time
+}
+
+func (OAuthAuthorizationCode) TableName() string {
+	return "oauth_authorization_codes"
+}
+
+type OAuthClientDTO struct {
+	Name         string   `json:"name" validate:"required,max=100" example:"Partner Bookshop" maxLength:"100"`
+	RedirectURIs []string `json:"redirect_uris" validate:"omitempty,max=10,dive,url,max=2048" example:"https://partner.example.com/callback"`
+	Scopes       []string `json:"scopes" validate:"required,min=1,dive,oneof=books:read books:write" example:"books:read"`
+	Confidential bool     `json:"confidential" example:"true"` // * gets a client secret, for apps that run on a server
+}
+
+type OAuthClientResponse struct {
+	ID           uint       `json:"id" example:"1"`
+	ClientID     string     `json:"client_id" example:"oc_5d2c9a0f3b7e1a64"`
+	Name         string     `json:"name" example:"Partner Bookshop"`
+	RedirectURIs []string   `json:"redirect_uris" example:"https://partner.example.com/callback"`
+	Scopes       []string   `json:"scopes" example:"books:read"`
+	Confidential bool       `json:"confidential" example:"true"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty" example:"2025-01-04T10:00:00Z"`
+	CreatedAt    time.Time  `json:"created_at" example:"2025-01-02T15:04:05Z"`
+}
+
+// * CreatedOAuthClientResponse is the only response that has the client secret
+type CreatedOAuthClientResponse struct {
+	OAuthClientResponse
+	ClientSecret string `json:"client_secret,omitempty" example:"mJ0q2v6c1Xr0k9..."`
+}
+
+type AuthorizeDTO struct {
+	ResponseType        string `json:"response_type" validate:"required,eq=code" example:"code"`
+	ClientID            string `json:"client_id" validate:"required" example:"oc_5d2c9a0f3b7e1a64"`
+	RedirectURI         string `json:"redirect_uri" validate:"required" example:"https://partner.example.com/callback"`
+	Scope               string `json:"scope" example:"books:read"` // * space separated, empty means every scope of the client
+	State               string `json:"state" validate:"max=500" example:"af0ifjsldkj"`
+	CodeChallenge       string `json:"code_challenge" validate:"required,len=43" example:"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"`
+	CodeChallengeMethod string `json:"code_challenge_method" validate:"required,eq=S256" example:"S256"`
+}
+
+type AuthorizeResponse struct {
+	RedirectTo string `json:"redirect_to" example:"https://partner.example.com/callback?code=SplxlOBeZQQYbYS6WxSbIA&state=af0ifjsldkj"`
+}
+
+// * OAuthTokenResponse is the RFC 6749 token response
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token" example:"eyJhbGciOiJSUzI1NiIsImtpZCI6..."`
+	TokenType    string `json:"token_type" example:"Bearer"`
+	ExpiresIn    int64  `json:"expires_in" example:"900"`
+	RefreshToken string `json:"refresh_token,omitempty" example:"6fJp1mB0c1Vd6O2m..."`
+	Scope        string `json:"scope" example:"books:read"`
+}
+
+func newOAuthTokenResponse(tokens *TokenPair) OAuthTokenResponse {
+	return OAuthTokenResponse{
+		AccessToken:  tokens.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    tokens.ExpiresIn,
+		RefreshToken: tokens.RefreshToken,
+		Scope:        tokens.Scope,
+	}
+}
+
+// * OAuthError is the RFC 6749 error response, the token endpoints answer with it instead of a Problem
+type OAuthError struct {
+	Error            string `json:"error" example:"invalid_grant"`
+	ErrorDescription string `json:"error_description,omitempty" example:"invalid or expired authorization code"`
+}
+
+// * IntrospectionResponse is the RFC 7662 answer, everything but active is left out for inactive tokens
+type IntrospectionResponse struct {
+	Active    bool   `json:"active" example:"true"`
+	Scope     string `json:"scope,omitempty" example:"books:read"`
+	ClientID  string `json:"client_id,omitempty" example:"oc_5d2c9a0f3b7e1a64"`
+	Subject   string `json:"sub,omitempty" example:"7"`
+	TokenType string `json:"token_type,omitempty" example:"access_token"`
+	ExpiresAt int64  `json:"exp,omitempty" example:"1735830245"`
+	IssuedAt  int64  `json:"iat,omitempty" example:"1735829345"`
+}
+
+var (
+	ErrOAuthClientNotFound = errors.New("OAuth client not found")
+	ErrInvalidOAuthClient  = errors.New("unknown client or wrong client secret")
+	ErrInvalidRedirectURI  = errors.New("redirect_uri is not registered for this client")
+	ErrInvalidOAuthScope   = errors.New("none of the requested scopes can be granted")
+	ErrInvalidOAuthGrant   = errors.New("invalid or expired authorization code")
+	ErrUnauthorizedClient  = errors.New("public clients can't use client credentials")
+)
+
+func newOAuthClientResponse(client *OAuthClient) OAuthClientResponse {
+	return OAuthClientResponse{
+		ID:           client.ID,
+		ClientID:     client.ClientID,
+		Name:         client.Name,
+		RedirectURIs: strings.Fields(client.RedirectURIs),
+		Scopes:       strings.Fields(client.Scopes),
+		Confidential: client.SecretHash != "",
+		RevokedAt:    client.RevokedAt,
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+func newOAuthClientResponses(clients []OAuthClient) []OAuthClientResponse {
+	responses := make([]OAuthClientResponse, 0, len(clients))
+	for i := range clients {
+		responses = append(responses, newOAuthClientResponse(&clients[i]))
+	}
+	return responses
+}
+
+// * createOAuthClient returns the new client and its secret in plain text (empty for public clients), which is never stored
+func createOAuthClient(db *gorm.DB, dto *OAuthClientDTO, createdBy *uint) (*OAuthClient, string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+
+	client := &OAuthClient{
+		ClientID:     oauthClientPrefix + hex.EncodeToString(id),
+		Name:         dto.Name,
+		RedirectURIs: strings.Join(dto.RedirectURIs, " "),
+		Scopes:       strings.Join(dto.Scopes, " "),
+		CreatedBy:    createdBy,
+	}
+
+	var secret string
+	if dto.Confidential {
+		var err error
+		secret, client.SecretHash, err = newOpaqueToken()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := db.Create(client).Error; err != nil {
+		return nil, "", err
+	}
+	return client, secret, nil
+}
+
+func getOAuthClients(db *gorm.DB) ([]OAuthClient, error) {
+	var clients []OAuthClient
+	result := db.Order("id").Find(&clients)
+	return clients, result.Error
+}
+
+// * revokeOAuthClient stops the client for good, the tokens it holds die with it
+func revokeOAuthClient(db *gorm.DB, id int) (*OAuthClient, error) {
+	var client OAuthClient
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ? AND revoked_at IS NULL", id).First(&client)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ErrOAuthClientNotFound
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+
+		now := time.Now()
+		if err := tx.Model(&client).Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&RefreshToken{}).
+			Where("client_id = ? AND revoked_at IS NULL", client.ClientID).
+			Update("revoked_at", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// * activeOAuthClient finds a client that wasn't revoked
+func activeOAuthClient(db *gorm.DB, clientID string) (*OAuthClient, error) {
+	var client OAuthClient
+	result := db.Where("client_id = ? AND revoked_at IS NULL", clientID).First(&client)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidOAuthClient
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &client, nil
+}
+
+// * authenticateOAuthClient checks the client's credentials, public clients only send their client_id
+func authenticateOAuthClient(db *gorm.DB, clientID, secret string) (*OAuthClient, error) {
+	client, err := activeOAuthClient(db, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if client.SecretHash == "" {
+		if secret != "" {
+			return nil, ErrInvalidOAuthClient
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.SecretHash)) != 1 {
+		return nil, ErrInvalidOAuthClient
+	}
+	return client, nil
+}
+
+// * oauthClientActive reports whether tokens of the client still count, revoking a client ends them at once
+func oauthClientActive(db *gorm.DB, clientID string) (bool, error) {
+	var active bool
+	result := db.Raw(`SELECT EXISTS (SELECT 1 FROM oauth_clients WHERE client_id = ? AND revoked_at IS NULL)`,
+		clientID).Scan(&active)
+
+	return active, result.Error
+}
+
+// * oauthScope is the requested scope cut down to what the client and (for a user) the user's role have,
+// * an empty request asks for everything the client has
+func oauthScope(requested string, client *OAuthClient, role string) (string, error) {
+	wanted := strings.Fields(requested)
+	if len(wanted) == 0 {
+		wanted = strings.Fields(client.Scopes)
+	}
+
+	var scopes []string
+	for _, s := range wanted {
+		if !slices.Contains(strings.Fields(client.Scopes), s) || slices.Contains(scopes, s) {
+			continue
+		}
+		if role != "" && !slices.Contains(scopesForRole[role], s) {
+			continue
+		}
+		scopes = append(scopes, s)
+	}
+	if len(scopes) == 0 {
+		return "", ErrInvalidOAuthScope
+	}
+	return strings.Join(scopes, " "), nil
+}
+
+// * authorizeOAuthClient records the user's consent and returns the code for the client's redirect_uri
+func authorizeOAuthClient(db *gorm.DB, user *User, dto *AuthorizeDTO, mfa bool) (string, error) {
+	client, err := activeOAuthClient(db, dto.ClientID)
+	if err != nil {
+		return "", err
+	}
+	if !slices.Contains(strings.Fields(client.RedirectURIs), dto.RedirectURI) {
+		return "", ErrInvalidRedirectURI
+	}
+	scope, err := oauthScope(dto.Scope, client, user.Role)
+	if err != nil {
+		return "", err
+	}
+
+	code, hash, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	result := db.Create(&OAuthAuthorizationCode{
+		CodeHash:      hash,
+		ClientID:      client.ClientID,
+		UserID:        user.ID,
+		RedirectURI:   dto.RedirectURI,
+		Scope:         scope,
+		CodeChallenge: dto.CodeChallenge,
+		MFA:           mfa,
+		ExpiresAt:     time.Now().Add(oauthCodeTTL),
+	})
+	if result.Error != nil {
+		return "", result.Error
+	}
+
+	return code, nil
+}
+
+// * exchangeAuthorizationCode is the authorization_code grant, the code must come back with the redirect_uri
+// * it was issued for and the PKCE verifier of its challenge. Another client presenting the code doesn't use it up.
+func exchangeAuthorizationCode(db *gorm.DB, client *OAuthClient, code, redirectURI, verifier string) (*TokenPair, error) {
+	var stored OAuthAuthorizationCode
+	result := db.Raw(`DELETE FROM oauth_authorization_codes
+		WHERE code_hash = ? AND client_id = ? AND redirect_uri = ? AND expires_at > ? RETURNING *`,
+		hashToken(code), client.ClientID, redirectURI, time.Now()).Scan(&stored)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInvalidOAuthGrant
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(challenge), []byte(stored.CodeChallenge)) != 1 {
+		return nil, ErrInvalidOAuthGrant
+	}
+
+	user, err := getUser(db, int(stored.UserID))
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrInvalidOAuthGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return issueScopedTokens(db, user, client.ClientID, stored.Scope, "", stored.MFA)
+}
+
+// * roleForScopes is the role a client acting as itself gets, just enough for its scopes
+func roleForScopes(scope string) string {
+	if slices.Contains(strings.Fields(scope), ScopeBooksWrite) {
+		return RoleEditor
+	}
+	return RoleReader
+}
+
+// * issueClientToken is the client_credentials grant, the token has no user and no refresh token
+func issueClientToken(client *OAuthClient, requested string) (string, string, error) {
+	if client.SecretHash == "" {
+		return "", "", ErrUnauthorizedClient
+	}
+	scope, err := oauthScope(requested, client, "")
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	token, err := signingKeys.sign(&AccessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   client.ClientID, // * RFC 9068, sub is the client when no user is involved
+			Issuer:    jwtIssuer,
+			Audience:  jwt.ClaimStrings{jwtAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        uuid.NewString(),
+		},
+		Role:          roleForScopes(scope),
+		SessionID:     uuid.NewString(),
+		Scope:         scope,
+		ClientID:      client.ClientID,
+		EmailVerified: true, // * there is no email to verify, the admin who registered the client vouched for it
+	})
+	return token, scope, err
+}
+
+// * parseOAuthAccessToken returns the claims of a live access token issued to clientID
+func parseOAuthAccessToken(db *gorm.DB, raw, clientID string) (*AccessClaims, error) {
+	claims := new(AccessClaims)
+	token, err := signingKeys.parse(raw, claims)
+	if err != nil || !token.Valid || claims.validate() != nil || claims.ClientID != clientID {
+		return nil, ErrInvalidOAuthGrant
+	}
+
+	revoked, err := tokenRevoked(db, claims.ID, claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrInvalidOAuthGrant
+	}
+	return claims, nil
+}
+
+// * introspectOAuthToken answers RFC 7662 for tokens of the calling client, other clients' tokens look inactive
+func introspectOAuthToken(db *gorm.DB, client *OAuthClient, raw string) (*IntrospectionResponse, error) {
+	claims, err := parseOAuthAccessToken(db, raw, client.ClientID)
+	if err == nil {
+		if claims.UserID != 0 {
+			disabled, err := accountDisabled(db, claims.UserID)
+			if err != nil || disabled {
+				return &IntrospectionResponse{Active: false}, err
+			}
+		}
+		return &IntrospectionResponse{
+			Active:    true,
+			Scope:     claims.Scope,
+			ClientID:  claims.ClientID,
+			Subject:   claims.Subject,
+			TokenType: "access_token",
+			ExpiresAt: claims.ExpiresAt.Unix(),
+			IssuedAt:  claims.IssuedAt.Unix(),
+		}, nil
+	}
+	if !errors.Is(err, ErrInvalidOAuthGrant) {
+		return nil, err
+	}
+
+	var stored RefreshToken
+	result := db.Where("token_hash = ? AND client_id = ? AND used_at IS NULL AND revoked_at IS NULL AND expires_at > ?",
+		hashToken(raw), client.ClientID, time.Now()).First(&stored)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return &IntrospectionResponse{Active: false}, nil
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &IntrospectionResponse{
+		Active:    true,
+		Scope:     stored.Scope,
+		ClientID:  stored.ClientID,
+		Subject:   strconv.FormatUint(uint64(stored.UserID), 10),
+		TokenType: "refresh_token",
+		ExpiresAt: stored.ExpiresAt.Unix(),
+		IssuedAt:  stored.CreatedAt.Unix(),
+	}, nil
+}
+
+// * revokeOAuthToken is RFC 7009, an access token goes on the deny list, a refresh token takes its whole family
+// * (and so the access tokens of that grant) with it. Unknown tokens are fine, there is nothing left to revoke.
+func revokeOAuthToken(db *gorm.DB, client *OAuthClient, raw string) error {
+	claims, err := parseOAuthAccessToken(db, raw, client.ClientID)
+	if err == nil {
+		err = revokeAccessToken(db, claims.ID, claims.ExpiresAt.Time)
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil
+		}
+		return err
+	}
+	if !errors.Is(err, ErrInvalidOAuthGrant) {
+		return err
+	}
+
+	var stored RefreshToken
+	result := db.Where("token_hash = ? AND client_id = ?", hashToken(raw), client.ClientID).First(&stored)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	return revokeTokenFamily(db, stored.FamilyID)
+}
+
+func purgeExpiredAuthorizationCodes(db *gorm.DB) error {
+	return db.Where("expires_at < ?", time.Now()).Delete(&OAuthAuthorizationCode{}).Error
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestExchangeAuthorizationCodeIgnoresOtherClients(t *testing.T) {
+	db := testDB(t)
+	user := createTestUser(t, db, testEmail(t))
+	redirectURI := "https://partner.example.com/callback"
+	newClient := func(name string) *OAuthClient {
+		client, _, err := createOAuthClient(db, &OAuthClientDTO{
+			Name:         name,
+			RedirectURIs: []string{redirectURI},
+			Scopes:       []string{ScopeBooksRead},
+			Confidential: true,
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	partner, other := newClient("Partner Bookshop"), newClient("Other App")
+
+	verifier := oauth2.GenerateVerifier()
+	sum := sha256.Sum256([]byte(verifier))
+	code, err := authorizeOAuthClient(db, user, &AuthorizeDTO{
+		ResponseType:        "code",
+		ClientID:            partner.ClientID,
+		RedirectURI:         redirectURI,
+		CodeChallenge:       base64.RawURLEncoding.EncodeToString(sum[:]),
+		CodeChallengeMethod: "S256",
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := exchangeAuthorizationCode(db, other, code, redirectURI, verifier); !errors.Is(err, ErrInvalidOAuthGrant) {
+		t.Fatalf("another client presenting the code: got %v, want %v", err, ErrInvalidOAuthGrant)
+	}
+	if _, err := exchangeAuthorizationCode(db, partner, code, redirectURI+"/elsewhere", verifier); !errors.Is(err, ErrInvalidOAuthGrant) {
+		t.Fatalf("another redirect_uri: got %v, want %v", err, ErrInvalidOAuthGrant)
+	}
+
+	tokens, err := exchangeAuthorizationCode(db, partner, code, redirectURI, verifier)
+	if err != nil {
+		t.Fatalf("the code was used up by the wrong client or redirect_uri: %v", err)
+	}
+	if tokens.AccessToken == "" {
+		t.Fatal("no access token")
+	}
+	if _, err := exchangeAuthorizationCode(db, partner, code, redirectURI, verifier); !errors.Is(err, ErrInvalidOAuthGrant) {
+		t.Fatalf("the code worked twice: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// * oidcStateCookie carries the state to the callback, so a callback URL made in another browser (login CSRF) fails
+const oidcStateCookie = "oidc_state"
+
+func oidcProblem(err error, detail string) error {
+	switch {
+	case errors.Is(err, ErrOIDCDisabled):
+		return newProblem(fiber.StatusNotFound, err.Error())
+	case errors.Is(err, ErrInvalidOIDCState), errors.Is(err, ErrInvalidOIDCResult):
+		return newProblem(fiber.StatusUnauthorized, err.Error())
+	case errors.Is(err, ErrOIDCEmailMissing), errors.Is(err, ErrAccountDisabled):
+		return newProblem(fiber.StatusForbidden, err.Error())
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return newProblem(fiber.StatusConflict, "the account was linked by another login at the same time, try again")
+	default:
+		return internalProblem(detail, err)
+	}
+}
+
+func oidcStateCookieFor(value string, expires time.Time) *fiber.Cookie {
+	return &fiber.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/auth/oidc",
+		Expires:  expires,
+		HTTPOnly: true,
+		Secure:   strings.HasPrefix(publicURL, "https://"),
+		SameSite: fiber.CookieSameSiteLaxMode, // * Lax, the provider's redirect back is a top-level navigation
+	}
+}
+
+// @Summary Single sign-on login
+// @Description Redirect to the OpenID Connect provider (authorization code flow with PKCE). After logging in there,
+// @Description the provider sends the browser to GET /auth/oidc/callback. 404 when OIDC_ISSUER is not configured.
+// @Tags auth
+// @Param login_hint query string false "Email to pre-fill at the provider"
+// @Param mode query string false "cookie for a browser session instead of tokens at the callback" Enums(cookie)
+// @Success 302
+// @Failure 404 {object} Problem "Not Found"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /auth/oidc/login [get]
+func OIDCLogin(c *fiber.Ctx) error {
+	url, state, err := beginOIDCLogin(gormdb, c.Query("login_hint"), cookieMode(c))
+	if err != nil {
+		return oidcProblem(err, "could not start single sign-on")
+	}
+
+	c.Cookie(oidcStateCookieFor(state, time.Now().Add(oidcStateTTL)))
+	return c.Redirect(url, fiber.StatusFound)
+}
+
+// @Summary Single sign-on callback
+// @Description Where the OpenID Connect provider sends the browser back to. The external account is linked to the
+// @Description user with the same email, or a new user is created, as long as the provider verified the email.
+// @Description Returns our own tokens like POST /login (a session cookie when the login started with ?mode=cookie),
+// @Description users with MFA get 202 and finish at POST /login/mfa.
+// @Tags auth
+// @Produce  json
+// @Param code query string true "Authorization code from the provider"
+// @Param state query string true "State from GET /auth/oidc/login"
+// @Success 200 {object} TokenResponse
+// @Success 202 {object} MFAChallengeResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 404 {object} Problem "Not Found"
+// @Failure 409 {object} Problem "Conflict"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /auth/oidc/callback [get]
+func OIDCCallback(c *fiber.Ctx) error {
+	if oidcClient == nil {
+		return oidcProblem(ErrOIDCDisabled, "")
+	}
+	if errorCode := c.Query("error"); errorCode != "" {
+		return newProblem(fiber.StatusUnauthorized, "the provider refused the login: "+errorCode)
+	}
+
+	state, code := c.Query("state"), c.Query("code")
+	if state == "" || code == "" {
+		return newProblem(fiber.StatusBadRequest, "state and code are required")
+	}
+	cookie := c.Cookies(oidcStateCookie)
+	c.Cookie(oidcStateCookieFor("", time.Unix(0, 0)))
+	if subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) != 1 {
+		return oidcProblem(ErrInvalidOIDCState, "")
+	}
+
+	claims, login, err := finishOIDCLogin(c.UserContext(), gormdb, state, code)
+	if err != nil {
+		return oidcProblem(err, "could not finish single sign-on")
+	}
+
+	user, err := loginOIDCUser(gormdb, oidcClient.issuer, claims)
+	var challenge *MFAChallenge
+	if errors.As(err, &challenge) {
+		return c.Status(fiber.StatusAccepted).JSON(MFAChallengeResponse{
+			Message:   "Enter the code from your authenticator app at POST /login/mfa",
+			MFAToken:  challenge.Token,
+			ExpiresIn: challenge.ExpiresIn,
+		})
+	}
+	if err != nil {
+		return oidcProblem(err, "could not log in")
+	}
+
+	return respondWithLogin(c, user, "oidc", false, login.Cookie)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+// * oidcStateTTL is how long a user has at the provider before the login has to start over
+const oidcStateTTL = 10 * time.Minute
+
+// * UserIdentity links an account at an OpenID Connect provider to a user, the provider's sub never changes
+// * while the email there may
+type UserIdentity struct {
+	ID          uint   `gorm:"primaryKey"`
+	UserID      uint   `gorm:"index;not null"`
+	Issuer      string `gorm:"uniqueIndex:idx_user_identities_subject;not null"`
+	Subject     string `gorm:"uniqueIndex:idx_user_identities_subject;not null"`
+	Email       string `gorm:"not null"` // * the email the provider had at the last login
+	LastLoginAt time.Time
+	CreatedAt   time.Time
+}
+
+// * OIDCLoginState is a login that went to the provider and hasn't come back yet, it is keyed by the
+// * sha256 of the state parameter and works once
+type OIDCLoginState struct {
+	StateHash string    `gorm:"primaryKey"`
+	Nonce     string    `gorm:"not null"`
+	Verifier  string    `gorm:"not null"`               // * PKCE code verifier, the provider only ever saw its S256 challenge
+	Cookie    bool      `gorm:"not null;default:false"` // * the login asked for a session cookie instead of tokens
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
+
+// * GORM would call it o_id_c_login_states, consumeOIDCState deletes from it by name
+func (OIDCLoginState) TableName() string {
+	return "oidc_login_states"
+}
+
+// * OIDCClaims are the ID token claims we use
+type OIDCClaims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Nonce         string `json:"nonce"`
+}
+
+// * oidcProvider is the configured provider, nil when OIDC_ISSUER is not set
+type oidcProvider struct {
+	issuer   string
+	config   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+var oidcClient *oidcProvider
+
+var (
+	ErrOIDCDisabled      = errors.New("single sign-on is not configured")
+	ErrInvalidOIDCState  = errors.New("invalid or expired login, start again")
+	ErrOIDCEmailMissing  = errors.New("the provider did not share a verified email")
+	ErrInvalidOIDCResult = errors.New("the provider's answer could not be verified")
+)
+
+// * setupOIDC fetches the provider's discovery document, it fails when the issuer can't be reached
+func setupOIDC(ctx context.Context, issuer, clientID, clientSecret, redirectURL string, scopes []string) error {
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return err
+	}
+
+	oidcClient = &oidcProvider{
+		issuer: issuer,
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  redirectURL,
+			Scopes:       scopes,
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+	}
+
+	return nil
+}
+
+// * beginOIDCLogin stores a new login and returns the provider URL to send the user to and its state,
+// * loginHint (optional) pre-fills the provider's login form, cookie asks for a session cookie at the end
+func beginOIDCLogin(db *gorm.DB, loginHint string, cookie bool) (string, string, error) {
+	if oidcClient == nil {
+		return "", "", ErrOIDCDisabled
+	}
+
+	state, stateHash, err := newOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, _, err := newOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	login := &OIDCLoginState{
+		StateHash: stateHash,
+		Nonce:     nonce,
+		Verifier:  verifier,
+		Cookie:    cookie,
+		ExpiresAt: time.Now().Add(oidcStateTTL),
+	}
+	if result := db.Create(login); result.Error != nil {
+		return "", "", result.Error
+	}
+
+	return oidcAuthCodeURL(state, login, loginHint), state, nil
+}
+
+// * oidcAuthCodeURL is the provider URL of a login, it carries the login's nonce and PKCE challenge
+func oidcAuthCodeURL(state string, login *OIDCLoginState, loginHint string) string {
+	opts := []oauth2.AuthCodeOption{oidc.Nonce(login.Nonce), oauth2.S256ChallengeOption(login.Verifier)}
+	if loginHint != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("login_hint", loginHint))
+	}
+	return oidcClient.config.AuthCodeURL(state, opts...)
+}
+
+// * consumeOIDCState takes the login of a state out of the table, a second callback with it finds nothing
+func consumeOIDCState(db *gorm.DB, state string) (*OIDCLoginState, error) {
+	var stored OIDCLoginState
+	result := db.Raw("DELETE FROM oidc_login_states WHERE state_hash = ? AND expires_at > ? RETURNING *",
+		hashToken(state), time.Now()).Scan(&stored)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInvalidOIDCState
+	}
+
+	return &stored, nil
+}
+
+// * finishOIDCLogin trades the code for an ID token and returns the verified claims and the login they finish
+func finishOIDCLogin(ctx context.Context, db *gorm.DB, state, code string) (*OIDCClaims, *OIDCLoginState, error) {
+	if oidcClient == nil {
+		return nil, nil, ErrOIDCDisabled
+	}
+
+	stored, err := consumeOIDCState(db, state)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	claims, err := exchangeOIDCCode(ctx, stored, code)
+	if err != nil {
+		return nil, nil, err
+	}
+	return claims, stored, nil
+}
+
+// * exchangeOIDCCode trades the code of a login for its ID token, with the login's PKCE verifier, and
+// * returns the claims once the token's signature and nonce check out
+func exchangeOIDCCode(ctx context.Context, login *OIDCLoginState, code string) (*OIDCClaims, error) {
+	token, err := oidcClient.config.Exchange(ctx, code, oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		return nil, errors.Join(ErrInvalidOIDCResult, err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, ErrInvalidOIDCResult
+	}
+
+	idToken, err := oidcClient.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidOIDCResult, err)
+	}
+
+	claims := new(OIDCClaims)
+	if err := idToken.Claims(claims); err != nil {
+		return nil, errors.Join(ErrInvalidOIDCResult, err)
+	}
+	// * the nonce ties the ID token to the login we started, so a token issued for another login is refused
+	if claims.Nonce != login.Nonce || claims.Subject == "" {
+		return nil, ErrInvalidOIDCResult
+	}
+
+	return claims, nil
+}
+
+// * oidcUser finds the user of an external identity. An unknown identity is linked to the user with its
+// * email, or gets a new user, but only when the provider verified that email.
+func oidcUser(db *gorm.DB, issuer string, claims *OIDCClaims) (*User, error) {
+	email := strings.TrimSpace(claims.Email)
+	var identity UserIdentity
+	result := db.Where("issuer = ? AND subject = ?", issuer, claims.Subject).First(&identity)
+
+	if result.Error == nil {
+		err := db.Model(&identity).Updates(map[string]interface{}{"email": email, "last_login_at": time.Now()}).Error
+		if err != nil {
+			return nil, err
+		}
+		return getUser(db, int(identity.UserID))
+	}
+	if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, result.Error
+	}
+
+	if email == "" || !claims.EmailVerified {
+		return nil, ErrOIDCEmailMissing
+	}
+
+	user := new(User)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("email = ?", email).First(user)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			// * nobody knows this password, the user can set one through POST /password/forgot
+			password, _, err := newOpaqueToken()
+			if err != nil {
+				return err
+			}
+			now := time.Now()
+			user = &User{Email: email, Password: password, DisplayName: truncate(claims.Name, 100), EmailVerifiedAt: &now}
+			if err := createUser(tx, user); err != nil {
+				return err
+			}
+		} else if result.Error != nil {
+			return result.Error
+		} else if user.EmailVerifiedAt == nil {
+			// * the provider just proved the email belongs to whoever is logging in
+			if err := tx.Model(user).Update("email_verified_at", time.Now()).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Create(&UserIdentity{
+			UserID:      user.ID,
+			Issuer:      issuer,
+			Subject:     claims.Subject,
+			Email:       email,
+			LastLoginAt: time.Now(),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func truncate(s string, n int) string {
+	if len([]rune(s)) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// * loginOIDCUser is loginUser for a user the provider vouched for, MFA still applies on top
+func loginOIDCUser(db *gorm.DB, issuer string, claims *OIDCClaims) (*User, error) {
+	user, err := oidcUser(db, issuer, claims)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrInvalidOIDCResult // * the linked user was deleted
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.DisabledAt != nil {
+		return nil, ErrAccountDisabled
+	}
+
+	if user.MFAEnabledAt != nil {
+		challenge, err := newMFAChallenge(user)
+		if err != nil {
+			return nil, err
+		}
+		return nil, challenge
+	}
+
+	return user, nil
+}
+
+func purgeExpiredOIDCStates(db *gorm.DB) error {
+	return db.Where("expires_at < ?", time.Now()).Delete(&OIDCLoginState{}).Error
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/oauth2"
+)
+
+// * mockAuthorization is a code the mock provider handed out and hasn't seen at its token endpoint yet
+type mockAuthorization struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+	email       string
+}
+
+// * mockIDTokenClaims is what the mock provider puts into its ID tokens
+type mockIDTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce         string `json:"nonce,omitempty"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name,omitempty"`
+}
+
+// * mockOIDCProvider is an OpenID Connect provider that approves every login at once, for whoever the
+// * login_hint names. The fields change what it vouches for, set them before the login starts.
+type mockOIDCProvider struct {
+	*httptest.Server
+	clientID      string
+	clientSecret  string
+	emailVerified bool
+	nonce         string // * when set, ID tokens carry this instead of the nonce of the login
+
+	keys  *keySet
+	mu    sync.Mutex
+	codes map[string]*mockAuthorization
+}
+
+// * newMockOIDCProvider starts a mock provider and points the API's single sign-on at it
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := newSigningKey("mock-oidc", private, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &mockOIDCProvider{
+		clientID:      "book-api",
+		clientSecret:  "secret",
+		emailVerified: true,
+		keys:          &keySet{keys: map[string]*signingKey{key.kid: key}, active: key},
+		codes:         map[string]*mockAuthorization{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) { writeJSON(w, http.StatusOK, p.keys.jwks()) })
+	mux.HandleFunc("GET /authorize", p.authorize)
+	mux.HandleFunc("POST /token", p.token)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+
+	err = setupOIDC(context.Background(), p.URL, p.clientID, p.clientSecret, "http://api.test/auth/oidc/callback",
+		[]string{"openid", "email", "profile"})
+	if err != nil {
+		t.Fatalf("set up single sign-on: %v", err)
+	}
+	t.Cleanup(func() { oidcClient = nil })
+	return p
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (p *mockOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.URL,
+		"authorization_endpoint":                p.URL + "/authorize",
+		"token_endpoint":                        p.URL + "/token",
+		"jwks_uri":                              p.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *mockOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("response_type") != "code" || query.Get("client_id") != p.clientID {
+		http.Error(w, "unknown client or response_type", http.StatusBadRequest)
+		return
+	}
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || redirect.Host == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code, _, err := newOpaqueToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nonce := query.Get("nonce")
+	if p.nonce != "" {
+		nonce = p.nonce
+	}
+
+	p.mu.Lock()
+	p.codes[code] = &mockAuthorization{
+		redirectURI: redirect.String(),
+		challenge:   query.Get("code_challenge"),
+		nonce:       nonce,
+		email:       query.Get("login_hint"),
+	}
+	p.mu.Unlock()
+
+	back := redirect.Query()
+	back.Set("code", code)
+	back.Set("state", query.Get("state"))
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if id != p.clientID || subtle.ConstantTimeCompare([]byte(secret), []byte(p.clientSecret)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	code := r.PostFormValue("code")
+	p.mu.Lock()
+	auth := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if r.PostFormValue("grant_type") != "authorization_code" || auth == nil ||
+		auth.redirectURI != r.PostFormValue("redirect_uri") ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != auth.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	idToken, err := p.keys.sign(&mockIDTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    p.URL,
+			Subject:   "mock|" + auth.email,
+			Audience:  jwt.ClaimStrings{p.clientID},
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		Nonce:         auth.nonce,
+		Email:         auth.email,
+		EmailVerified: p.emailVerified,
+		Name:          "SSO User",
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "mock-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func newOIDCTestApp() *fiber.App {
+	app := fiber.New(fiber.Config{ErrorHandler: problemErrorHandler})
+	app.Get("/auth/oidc/login", OIDCLogin)
+	app.Get("/auth/oidc/callback", OIDCCallback)
+	app.Post("/login/mfa", LoginMFA)
+	return app
+}
+
+// * oidcLogin starts a single sign-on as email, lets the mock provider approve it and returns the request the
+// * browser would then send to the callback, state cookie included
+func oidcLogin(t *testing.T, app *fiber.App, email string) *http.Request {
+	t.Helper()
+	resp := testRequest(t, app, httptest.NewRequest(http.MethodGet, "/auth/oidc/login?login_hint="+url.QueryEscape(email), nil))
+	if resp.StatusCode != fiber.StatusFound {
+		t.Fatalf("GET /auth/oidc/login: got %d, want 302", resp.StatusCode)
+	}
+	var stateCookie *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == oidcStateCookie {
+			stateCookie = cookie
+		}
+	}
+	if stateCookie == nil {
+		t.Fatal("GET /auth/oidc/login set no state cookie")
+	}
+
+	browser := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	approved, err := browser.Get(resp.Header.Get(fiber.HeaderLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	approved.Body.Close()
+	if approved.StatusCode != http.StatusFound {
+		t.Fatalf("provider authorize: got %d, want 302", approved.StatusCode)
+	}
+	callback, err := url.Parse(approved.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?"+callback.RawQuery, nil)
+	req.AddCookie(&http.Cookie{Name: stateCookie.Name, Value: stateCookie.Value})
+	return req
+}
+
+func TestOIDCLinksUserByVerifiedEmail(t *testing.T) {
+	db := testDB(t)
+	provider := newMockOIDCProvider(t)
+	app := newOIDCTestApp()
+	email := testEmail(t)
+	user := createTestUser(t, db, email)
+
+	resp := testRequest(t, app, oidcLogin(t, app, email))
+	expectStatus(t, resp, fiber.StatusOK)
+	var tokens TokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil || tokens.Token == "" {
+		t.Fatalf("callback returned no token: %v", err)
+	}
+
+	var identity UserIdentity
+	if err := db.Where("issuer = ? AND subject = ?", provider.URL, "mock|"+email).First(&identity).Error; err != nil {
+		t.Fatalf("no identity was linked: %v", err)
+	}
+	if identity.UserID != user.ID {
+		t.Fatalf("identity linked to user %d, want %d", identity.UserID, user.ID)
+	}
+	linked, err := getUser(db, int(user.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked.EmailVerifiedAt == nil {
+		t.Fatal("the email the provider verified is still unverified")
+	}
+
+	// * the second login goes through the identity
+	resp = testRequest(t, app, oidcLogin(t, app, email))
+	expectStatus(t, resp, fiber.StatusOK)
+}
+
+func TestOIDCRejectsUnverifiedEmail(t *testing.T) {
+	db := testDB(t)
+	provider := newMockOIDCProvider(t)
+	provider.emailVerified = false
+	app := newOIDCTestApp()
+	email := testEmail(t)
+	createTestUser(t, db, email)
+
+	resp := testRequest(t, app, oidcLogin(t, app, email))
+	expectStatus(t, resp, fiber.StatusForbidden)
+
+	var linked int64
+	db.Model(&UserIdentity{}).Where("issuer = ? AND subject = ?", provider.URL, "mock|"+email).Count(&linked)
+	if linked != 0 {
+		t.Fatal("an unverified email was linked to the user with that email")
+	}
+}
+
+func TestOIDCRejectsDisabledLinkedUser(t *testing.T) {
+	db := testDB(t)
+	newMockOIDCProvider(t)
+	app := newOIDCTestApp()
+	email := testEmail(t)
+	user := createTestUser(t, db, email)
+
+	resp := testRequest(t, app, oidcLogin(t, app, email))
+	expectStatus(t, resp, fiber.StatusOK)
+	if err := db.Model(user).Update("disabled_at", time.Now()).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	resp = testRequest(t, app, oidcLogin(t, app, email))
+	expectStatus(t, resp, fiber.StatusForbidden)
+}
+
+func TestOIDCHandsOffToMFA(t *testing.T) {
+	db := testDB(t)
+	newMockOIDCProvider(t)
+	app := newOIDCTestApp()
+	email := testEmail(t)
+	user := createTestUser(t, db, email)
+	secret := "JBSWY3DPEHPK3PXP"
+	err := db.Model(user).Updates(map[string]interface{}{"mfa_enabled_at": time.Now(), "totp_secret": secret}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := testRequest(t, app, oidcLogin(t, app, email))
+	expectStatus(t, resp, fiber.StatusAccepted)
+	var challenge MFAChallengeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&challenge); err != nil || challenge.MFAToken == "" {
+		t.Fatalf("callback returned no mfa_token: %v", err)
+	}
+
+	code, err := totp.GenerateCodeCustom(secret, time.Now(), totp.ValidateOpts{
+		Period:    totpPeriod,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(MFALoginDTO{MFAToken: challenge.MFAToken, Code: code})
+	req := httptest.NewRequest(http.MethodPost, "/login/mfa", strings.NewReader(string(body)))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+
+	resp = testRequest(t, app, req)
+	expectStatus(t, resp, fiber.StatusOK)
+}
+
+// * approveAtMock sends a login straight to the mock provider, without the API and its database, and returns
+// * the code the provider sent back
+func approveAtMock(t *testing.T, login *OIDCLoginState, email string) string {
+	t.Helper()
+	browser := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	approved, err := browser.Get(oidcAuthCodeURL("mock-state", login, email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	approved.Body.Close()
+	callback, err := url.Parse(approved.Header.Get("Location"))
+	if err != nil || approved.StatusCode != http.StatusFound {
+		t.Fatalf("provider authorize: got %d, want 302", approved.StatusCode)
+	}
+	if callback.Query().Get("state") != "mock-state" {
+		t.Fatalf("provider sent back state %q", callback.Query().Get("state"))
+	}
+	return callback.Query().Get("code")
+}
+
+func newTestOIDCLogin() *OIDCLoginState {
+	nonce, _, _ := newOpaqueToken()
+	return &OIDCLoginState{Nonce: nonce, Verifier: oauth2.GenerateVerifier()}
+}
+
+func TestOIDCExchangeReturnsVerifiedClaims(t *testing.T) {
+	newMockOIDCProvider(t)
+	login := newTestOIDCLogin()
+	code := approveAtMock(t, login, "sso@example.com")
+
+	claims, err := exchangeOIDCCode(context.Background(), login, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Email != "sso@example.com" || !claims.EmailVerified || claims.Subject != "mock|sso@example.com" {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+}
+
+func TestOIDCCallbackRejectsStateMismatch(t *testing.T) {
+	newMockOIDCProvider(t)
+	app := newOIDCTestApp()
+
+	// * the state check comes before the database, a mismatch never reaches it
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?state=the-state&code=the-code", nil)
+	req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: "someone-elses-state"})
+	resp := testRequest(t, app, req)
+	expectStatus(t, resp, fiber.StatusUnauthorized)
+
+	req = httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?state=the-state&code=the-code", nil)
+	resp = testRequest(t, app, req)
+	expectStatus(t, resp, fiber.StatusUnauthorized)
+}
+
+func TestOIDCExchangeRejectsNonceMismatch(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	provider.nonce = "replayed-nonce"
+	login := newTestOIDCLogin()
+	code := approveAtMock(t, login, "sso@example.com")
+
+	if _, err := exchangeOIDCCode(context.Background(), login, code); !errors.Is(err, ErrInvalidOIDCResult) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidOIDCResult)
+	}
+}
+
+func TestOIDCExchangeRejectsWrongPKCEVerifier(t *testing.T) {
+	newMockOIDCProvider(t)
+	login := newTestOIDCLogin()
+	code := approveAtMock(t, login, "sso@example.com")
+	login.Verifier = oauth2.GenerateVerifier()
+
+	if _, err := exchangeOIDCCode(context.Background(), login, code); !errors.Is(err, ErrInvalidOIDCResult) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidOIDCResult)
+	}
+}
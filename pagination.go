@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/url"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+	maxPage          = math.MaxInt32 / maxPageLimit // * keeps (page-1)*limit a valid OFFSET
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type PageLinks struct {
+	Next string `json:"next,omitempty" example:"http://localhost:8080/books?page=3&limit=20"`
+	Prev string `json:"prev,omitempty" example:"http://localhost:8080/books?page=1&limit=20"`
+}
+
+// * pageCursor is what we hide behind the opaque cursor string, the sort it was made for,
+// * the sort value and id of the row we stopped at, and which way we are walking
+type pageCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+	Prev  bool   `json:"p,omitempty"`
+}
+
+func encodeCursor(cur pageCursor) string {
+	raw, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var cur pageCursor
+
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cur, ErrInvalidCursor
+	}
+
+	if err := json.Unmarshal(raw, &cur); err != nil || cur.ID == 0 {
+		return cur, ErrInvalidCursor
+	}
+
+	return cur, nil
+}
+
+// * parsePageLimit reads page and limit from the query string, falling back to the defaults
+func parsePageLimit(c *fiber.Ctx) (int, int, error) {
+	page, limit := 1, defaultPageLimit
+
+	if v := c.Query("page"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 || p > maxPage {
+			return 0, 0, errors.New("page must be between 1 and " + strconv.Itoa(maxPage))
+		}
+		page = p
+	}
+
+	if v := c.Query("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > maxPageLimit {
+			return 0, 0, errors.New("limit must be between 1 and " + strconv.Itoa(maxPageLimit))
+		}
+		limit = l
+	}
+
+	return page, limit, nil
+}
+
+// * pageLink rebuilds the current request URL with some query params replaced (or removed when the value is empty)
+func pageLink(c *fiber.Ctx, set map[string]string) string {
+	values, _ := url.ParseQuery(string(c.Request().URI().QueryString()))
+
+	for k, v := range set {
+		if v == "" {
+			values.Del(k)
+			continue
+		}
+		values.Set(k, v)
+	}
+
+	return c.BaseURL() + c.Path() + "?" + values.Encode()
+}
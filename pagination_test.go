@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestParsePageLimit(t *testing.T) {
+	tests := []struct {
+		query   string
+		page    int
+		limit   int
+		invalid bool
+	}{
+		{"", 1, defaultPageLimit, false},
+		{"page=3&limit=50", 3, 50, false},
+		{"page=" + strconv.Itoa(maxPage) + "&limit=100", maxPage, 100, false},
+		{"page=" + strconv.Itoa(maxPage+1), 0, 0, true},
+		{"page=9223372036854775807", 0, 0, true},
+		{"page=0", 0, 0, true},
+		{"limit=101", 0, 0, true},
+	}
+	for _, tt := range tests {
+		app := fiber.New()
+		app.Get("/", func(c *fiber.Ctx) error {
+			page, limit, err := parsePageLimit(c)
+			if (err != nil) != tt.invalid || page != tt.page || limit != tt.limit {
+				t.Errorf("?%s: got %d, %d, %v", tt.query, page, limit, err)
+			}
+			if err == nil && (page-1)*limit < 0 {
+				t.Errorf("?%s: negative offset", tt.query)
+			}
+			return nil
+		})
+		if _, err := app.Test(httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
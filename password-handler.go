@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func passwordResetMail(user *User, token string) Mail {
+	link := "send this token to POST /password/reset:\n\n" + token
+	if passwordResetURL != "" {
+		link = "open\n\n" + passwordResetURL + "?token=" + url.QueryEscape(token)
+	}
+
+	return Mail{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: "Someone asked to reset the password of your account. If it was you, " + link + "\n\n" +
+			"It works once and expires in " + passwordResetTTL.String() + ". If it wasn't you, ignore this email.",
+	}
+}
+
+// @Summary Forgot password
+// @Description Email a single-use password reset token to the user. The response is the same, and as fast,
+// @Description whether or not the email is registered, so this can't be used to find out who has an account.
+// @Description An email gets 3 requests and a client IP 20 before they are locked out like failed logins.
+// @Tags auth
+// @Accept  json
+// @Produce  json
+// @Param Forgot body ForgotPasswordDTO true "Forgot password DTO"
+// @Success 202 {object} MessageResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 429 {object} Problem "Too Many Requests"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /password/forgot [post]
+func ForgotPassword(c *fiber.Ctx) error {
+	dto := new(ForgotPasswordDTO)
+
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
+
+	dto.Email = strings.TrimSpace(dto.Email)
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
+
+	// * every request counts, so nobody can flood an inbox with reset emails
+	account := loginThrottle{key: passwordResetThrottleKey(dto.Email), free: passwordResetFreeRequests}
+	ip := loginThrottle{key: passwordResetIPThrottleKey(c.IP()), free: ipFreeFailures}
+	if err := checkThrottles(c, account, ip); err != nil {
+		return err
+	}
+	if err := recordFailedLogin(c, account, ip); err != nil {
+		return err
+	}
+
+	startPasswordReset(gormdb, dto.Email)
+
+	return c.Status(fiber.StatusAccepted).JSON(MessageResponse{
+		Message: "If the email is registered, a reset link has been sent",
+	})
+}
+
+// @Summary Reset password
+// @Description Set a new password with the token from POST /password/forgot. The token works once,
+// @Description and every session of the user (access and refresh tokens) is revoked.
+// @Tags auth
+// @Accept  json
+// @Produce  json
+// @Param Reset body ResetPasswordDTO true "Reset password DTO"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /password/reset [post]
+func ResetPassword(c *fiber.Ctx) error {
+	dto := new(ResetPasswordDTO)
+
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
+
+	err := resetPassword(gormdb, dto.Token, dto.Password)
+	if errors.Is(err, ErrInvalidResetToken) {
+		return newProblem(fiber.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return internalProblem("could not reset password", err)
+	}
+
+	return c.JSON(MessageResponse{
+		Message: "Password reset successful",
+	})
+}
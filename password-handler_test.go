@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestForgotPasswordIsThrottledPerEmail(t *testing.T) {
+	testDB(t)
+	app := fiber.New(fiber.Config{ErrorHandler: problemErrorHandler})
+	app.Post("/password/forgot", ForgotPassword)
+	email := testEmail(t) // * unknown, so nothing is mailed
+
+	for i := 0; i <= passwordResetFreeRequests; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/password/forgot", strings.NewReader(`{"email": "`+email+`"}`))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp := testRequest(t, app, req)
+
+		want := fiber.StatusAccepted
+		if i == passwordResetFreeRequests {
+			want = fiber.StatusTooManyRequests
+		}
+		expectStatus(t, resp, want)
+	}
+}
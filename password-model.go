@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// * PasswordResetToken is a single-use token mailed by POST /password/forgot, only its sha256 is stored
+type PasswordResetToken struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index;not null"`
+	TokenHash string `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+type ForgotPasswordDTO struct {
+	Email string `json:"email" validate:"required,email" example:"user@example.com"`
+}
+
+type ResetPasswordDTO struct {
+	Token    string `json:"token" validate:"required" example:"Q2hhbmdlTWU..."`
+	Password string `json:"password" validate:"required,min=8,maxbytes=72,password" example:"newSecurePassword123" minLength:"8" maxLength:"72"`
+}
+
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+// * createPasswordResetToken returns a new reset token for the user with that email.
+// * Earlier tokens of the user stop working, only the newest email is valid.
+func createPasswordResetToken(db *gorm.DB, email string) (string, *User, error) {
+	var user User
+	result := db.Where("email = ?", email).First(&user)
+
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return "", nil, ErrUserNotFound
+	}
+	if result.Error != nil {
+		return "", nil, result.Error
+	}
+
+	token, hash, err := newOpaqueToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&PasswordResetToken{}).
+			Where("user_id = ? AND used_at IS NULL", user.ID).
+			Update("used_at", time.Now()).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&PasswordResetToken{
+			UserID:    user.ID,
+			TokenHash: hash,
+			ExpiresAt: time.Now().Add(passwordResetTTL),
+		}).Error
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, &user, nil
+}
+
+// * startPasswordReset creates the token and mails it off the request path, so a registered email takes as long
+// * to answer as an unknown one
+func startPasswordReset(db *gorm.DB, email string) {
+	go func() {
+		token, user, err := createPasswordResetToken(db, email)
+		if errors.Is(err, ErrUserNotFound) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error start password reset: %v", err)
+			return
+		}
+
+		sendMail(passwordResetMail(user, token))
+	}()
+}
+
+// * resetPassword uses up a reset token, sets the new password and logs the user out everywhere.
+// * Revoking every refresh token family also kills the access tokens, they carry their family as sid.
+func resetPassword(db *gorm.DB, raw, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var stored PasswordResetToken
+		result := tx.Where("token_hash = ?", hashToken(raw)).First(&stored)
+
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ErrInvalidResetToken
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+		if stored.UsedAt != nil || time.Now().After(stored.ExpiresAt) {
+			return ErrInvalidResetToken
+		}
+
+		// * only one of two concurrent resets with the same token can win this update
+		result = tx.Model(&PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL", stored.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidResetToken
+		}
+
+		result = tx.Model(&User{}).Where("id = ?", stored.UserID).Updates(map[string]interface{}{
+			"password":                string(hashedPassword),
+			"password_reset_required": false,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidResetToken
+		}
+
+		return revokeUserSessions(tx, stored.UserID)
+	})
+}
+
+func purgeExpiredResetTokens(db *gorm.DB) error {
+	return db.Where("expires_at < ?", time.Now()).Delete(&PasswordResetToken{}).Error
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+// * applyPatch patches the JSON form of current and decodes the result into out.
+// * application/merge-patch+json (RFC 7396, plain application/json is treated the same) sets the fields
+// * that are present and clears the ones sent as null, application/json-patch+json (RFC 6902) applies
+// * the list of operations in order.
+func applyPatch(current interface{}, contentType string, patch []byte, out interface{}) error {
+	doc, err := json.Marshal(current)
+	if err != nil {
+		return internalProblem("could not encode resource", err)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	var patched []byte
+	switch mediaType {
+	case mergePatchContentType, fiber.MIMEApplicationJSON:
+		if !json.Valid(patch) {
+			return newProblem(fiber.StatusBadRequest, "merge patch is not valid JSON")
+		}
+		if patched, err = jsonpatch.MergePatch(doc, patch); err != nil {
+			return newProblem(fiber.StatusBadRequest, "invalid merge patch: "+err.Error())
+		}
+	case jsonPatchContentType:
+		ops, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return newProblem(fiber.StatusBadRequest, "invalid JSON patch: "+err.Error())
+		}
+		if patched, err = ops.Apply(doc); err != nil {
+			return newProblem(fiber.StatusUnprocessableEntity, "could not apply JSON patch: "+err.Error())
+		}
+	default:
+		return newProblem(fiber.StatusUnsupportedMediaType,
+			"use "+mergePatchContentType+" or "+jsonPatchContentType)
+	}
+
+	// * a patch may add members the resource doesn't have, reject those instead of dropping them
+	decoder := json.NewDecoder(bytes.NewReader(patched))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(out); err != nil {
+		return newProblem(fiber.StatusUnprocessableEntity, "patched resource is invalid: "+err.Error())
+	}
+
+	return nil
+}
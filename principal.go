@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	ScopeBooksRead  = "books:read"
+	ScopeBooksWrite = "books:write"
+)
+
+// * scopesForRole is what a user's own login token may do, narrower credentials get a subset
+var scopesForRole = map[string][]string{
+	RoleReader: {ScopeBooksRead},
+	RoleEditor: {ScopeBooksRead, ScopeBooksWrite},
+	RoleAdmin:  {ScopeBooksRead, ScopeBooksWrite},
+}
+
+// * AccessClaims is the payload of our access tokens
+type AccessClaims struct {
+	jwt.RegisteredClaims
+	UserID    uint   `json:"user_id"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid"`
+	Scope     string `json:"scope,omitempty"`     // * space separated, like OAuth2
+	ClientID  string `json:"client_id,omitempty"` // * the OAuth client the token was issued to (RFC 9068), empty for our own logins
+
+	EmailVerified bool     `json:"email_verified"`
+	AMR           []string `json:"amr,omitempty"` // * authentication methods (RFC 8176), "mfa" after a second factor
+
+	Act *ActorClaim `json:"act,omitempty"` // * set on impersonation tokens, the admin who is really acting (RFC 8693)
+}
+
+type ActorClaim struct {
+	Subject string `json:"sub"`
+}
+
+// * validate checks the standard claims on top of what jwt already did (exp/nbf/iat when present)
+func (claims *AccessClaims) validate() error {
+	if claims.ExpiresAt == nil {
+		return errors.New("token has no exp")
+	}
+	if claims.ID == "" {
+		return errors.New("token has no jti")
+	}
+	if !claims.VerifyIssuer(jwtIssuer, true) {
+		return errors.New("token has the wrong iss")
+	}
+	if !claims.VerifyAudience(jwtAudience, true) {
+		return errors.New("token has the wrong aud")
+	}
+	return nil
+}
+
+// * Principal is who is calling, authRequired puts it in c.Locals for the handlers
+type Principal struct {
+	UserID    uint
+	Roles     []string // * the user's role and every role below it
+	TokenID   string
+	SessionID string
+	Scopes    []string
+	ExpiresAt time.Time
+
+	EmailVerified bool
+	MFA           bool // * the login passed a second factor
+
+	ImpersonatorID  uint   // * the admin behind an impersonation token, 0 for normal tokens
+	APIKeyID        uint   // * set when the caller used an API key instead of a token
+	ClientID        string // * set when the token was issued to an OAuth client, UserID is 0 for client credentials
+	CookieSessionID uint   // * set when the caller used a session cookie instead of a token
+}
+
+const principalKey = "principal"
+
+// * impliedRoles expands a role into itself plus every role it includes, admin -> [reader editor admin]
+func impliedRoles(role string) []string {
+	var roles []string
+	for _, r := range []string{RoleReader, RoleEditor, RoleAdmin} {
+		if roleRank[r] <= roleRank[role] {
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
+
+func newPrincipal(claims *AccessClaims) *Principal {
+	var impersonatorID uint
+	if claims.Act != nil {
+		id, _ := strconv.ParseUint(claims.Act.Subject, 10, 32)
+		impersonatorID = uint(id)
+	}
+
+	return &Principal{
+		UserID:    claims.UserID,
+		Roles:     impliedRoles(claims.Role),
+		TokenID:   claims.ID,
+		SessionID: claims.SessionID,
+		Scopes:    strings.Fields(claims.Scope),
+		ExpiresAt: claims.ExpiresAt.Time,
+
+		EmailVerified: claims.EmailVerified,
+		MFA:           slices.Contains(claims.AMR, "mfa"),
+
+		ImpersonatorID: impersonatorID,
+		ClientID:       claims.ClientID,
+	}
+}
+
+// * Role is the caller's own role, the highest of Roles
+func (p *Principal) Role() string {
+	if len(p.Roles) == 0 {
+		return ""
+	}
+	return p.Roles[len(p.Roles)-1]
+}
+
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// * newAPIKeyPrincipal is the caller behind an API key, it acts as its user within the key's scopes
+func newAPIKeyPrincipal(key *APIKey, user *User) *Principal {
+	return &Principal{
+		UserID:    user.ID,
+		Roles:     impliedRoles(user.Role),
+		TokenID:   "apikey:" + strconv.FormatUint(uint64(key.ID), 10),
+		Scopes:    grantedScopes(key.Scopes, user.Role),
+		ExpiresAt: key.ExpiresAt,
+
+		EmailVerified: user.EmailVerifiedAt != nil,
+		MFA:           key.MFA,
+		APIKeyID:      key.ID,
+	}
+}
+
+// * currentPrincipal is nil on routes without authRequired
+func currentPrincipal(c *fiber.Ctx) *Principal {
+	principal, _ := c.Locals(principalKey).(*Principal)
+	return principal
+}
+
+// * currentUserID is the id of the caller, 0 when nobody is authenticated
+func currentUserID(c *fiber.Ctx) uint {
+	if principal := currentPrincipal(c); principal != nil {
+		return principal.UserID
+	}
+	return 0
+}
+
+// * actorID is currentUserID as a nullable column value, for created_by/updated_by
+func actorID(c *fiber.Ctx) *uint {
+	id := currentUserID(c)
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
+
+func newAccessClaims(user *User, familyID, jti string, mfa bool, now time.Time) *AccessClaims {
+	amr := []string{"pwd"}
+	if mfa {
+		amr = append(amr, "otp", "mfa")
+	}
+
+	return &AccessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			Issuer:    jwtIssuer,
+			Audience:  jwt.ClaimStrings{jwtAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        jti,
+		},
+		UserID:    user.ID,
+		Role:      user.Role,
+		SessionID: familyID, // * ties the access token to its refresh token family, so revoking one kills both
+		Scope:     strings.Join(scopesForRole[user.Role], " "),
+
+		EmailVerified: user.EmailVerifiedAt != nil,
+		AMR:           amr,
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// * hasRole reports whether the caller's role is at least role, it relies on authRequired having run
+func hasRole(c *fiber.Ctx, role string) bool {
+	principal := currentPrincipal(c)
+	return principal != nil && principal.HasRole(role)
+}
+
+// * requireRole is the route-level authorization middleware, mount it after authRequired.
+// * When admins require MFA for the caller's own role, the token must also come from a login with a second factor.
+func requireRole(role string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !hasRole(c, role) {
+			return newProblem(fiber.StatusForbidden, role+" role required")
+		}
+		if principal := currentPrincipal(c); mfaPolicy.requires(principal.Role()) && !principal.MFA {
+			return newProblem(fiber.StatusForbidden, principal.Role()+" role requires MFA, enable it at POST /me/mfa/totp and log in again")
+		}
+
+		return c.Next()
+	}
+}
+
+// * requireScope is requireRole for scopes, API keys only get the scopes they were created with
+func requireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if principal := currentPrincipal(c); principal == nil || !principal.HasScope(scope) {
+			return newProblem(fiber.StatusForbidden, scope+" scope required")
+		}
+
+		return c.Next()
+	}
+}
+
+// * denyImpersonation keeps impersonation tokens away from a user's credentials and account, an admin can look
+// * around as the user but not lock them out
+func denyImpersonation(c *fiber.Ctx) error {
+	if principal := currentPrincipal(c); principal != nil && principal.ImpersonatorID != 0 {
+		return newProblem(fiber.StatusForbidden, "not allowed with an impersonation token")
+	}
+
+	return c.Next()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRequireRoleChecksMFAPolicyForCallersRole(t *testing.T) {
+	previous := mfaPolicy.list()
+	t.Cleanup(func() { mfaPolicy.set(previous) })
+
+	tests := []struct {
+		policy []string
+		caller string
+		mfa    bool
+		route  string
+		want   int
+	}{
+		{[]string{RoleAdmin}, RoleAdmin, false, RoleReader, fiber.StatusForbidden},
+		{[]string{RoleAdmin}, RoleAdmin, false, RoleAdmin, fiber.StatusForbidden},
+		{[]string{RoleAdmin}, RoleAdmin, true, RoleReader, fiber.StatusOK},
+		{[]string{RoleAdmin}, RoleEditor, false, RoleEditor, fiber.StatusOK},
+		{[]string{RoleEditor}, RoleAdmin, false, RoleEditor, fiber.StatusOK},
+		{[]string{RoleEditor}, RoleEditor, false, RoleReader, fiber.StatusForbidden},
+		{nil, RoleReader, false, RoleEditor, fiber.StatusForbidden},
+	}
+	for _, tt := range tests {
+		mfaPolicy.set(tt.policy)
+		app := fiber.New(fiber.Config{ErrorHandler: problemErrorHandler})
+		app.Get("/", func(c *fiber.Ctx) error {
+			c.Locals(principalKey, &Principal{UserID: 1, Roles: impliedRoles(tt.caller), MFA: tt.mfa})
+			return c.Next()
+		}, requireRole(tt.route), func(c *fiber.Ctx) error {
+			return c.SendStatus(fiber.StatusOK)
+		})
+
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("policy %v, %s (mfa %v) on a %s route: got %d, want %d",
+				tt.policy, tt.caller, tt.mfa, tt.route, resp.StatusCode, tt.want)
+		}
+	}
+}
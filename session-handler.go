@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// * the __Host- prefix makes browsers insist on Secure, Path=/ and no Domain, so a subdomain can't plant them
+const (
+	sessionCookie = "__Host-session"
+	csrfCookie    = "__Host-csrf"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// * cookieMode reports whether a login asked for a session cookie (?mode=cookie) instead of tokens
+func cookieMode(c *fiber.Ctx) bool {
+	return c.Query("mode") == "cookie"
+}
+
+func setSessionCookies(c *fiber.Ctx, token, csrf string, expires time.Time) {
+	c.Cookie(&fiber.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HTTPOnly: true,
+		Secure:   true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	// * readable by the frontend's JavaScript, which echoes it in X-CSRF-Token, another site can't read it
+	c.Cookie(&fiber.Cookie{
+		Name:     csrfCookie,
+		Value:    csrf,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+func clearSessionCookies(c *fiber.Ctx) {
+	setSessionCookies(c, "", "", time.Unix(0, 0))
+}
+
+// * respondWithLogin finishes a successful login, with a session cookie in cookie mode and with tokens otherwise.
+// * A token login starts a new refresh token family. method is the step that finished the login, for the audit log.
+func respondWithLogin(c *fiber.Ctx, user *User, method string, mfa, cookie bool) error {
+	event := AuditEvent{
+		Action:  "login.succeeded",
+		ActorID: &user.ID,
+		Subject: userSubject(int(user.ID)),
+		Details: map[string]interface{}{"method": method, "mfa": mfa},
+	}
+
+	if !cookie {
+		tokens, err := issueTokens(gormdb, user, "", mfa)
+		if errors.Is(err, ErrAccountDisabled) {
+			return newProblem(fiber.StatusForbidden, err.Error())
+		}
+		if err != nil {
+			return internalProblem("could not log in", err)
+		}
+		event.Details["family_id"] = tokens.FamilyID
+		recordAudit(c, event)
+		return c.Status(fiber.StatusOK).JSON(newTokenResponse("Login successful", tokens))
+	}
+
+	session, token, csrf, err := createSession(gormdb, user, mfa, c.IP(), c.Get(fiber.HeaderUserAgent))
+	if errors.Is(err, ErrAccountDisabled) {
+		return newProblem(fiber.StatusForbidden, err.Error())
+	}
+	if err != nil {
+		return internalProblem("could not log in", err)
+	}
+
+	event.Details["session_id"] = session.ID
+	recordAudit(c, event)
+
+	setSessionCookies(c, token, csrf, session.ExpiresAt)
+	return c.Status(fiber.StatusOK).JSON(SessionResponse{
+		Message:   "Login successful",
+		CSRFToken: csrf,
+		ExpiresAt: session.ExpiresAt,
+	})
+}
+
+// * safeMethod is a request that must not change anything, so it needs no CSRF token
+func safeMethod(method string) bool {
+	return method == fiber.MethodGet || method == fiber.MethodHead || method == fiber.MethodOptions
+}
+
+// * authenticateSessionCookie is authRequired for a session cookie. Browsers send cookies along with requests
+// * other sites trigger, so every other method must also prove it came from our frontend (double-submit CSRF token).
+func authenticateSessionCookie(c *fiber.Ctx, token string) error {
+	session, err := authenticateSession(gormdb, token)
+	if errors.Is(err, ErrInvalidSession) {
+		clearSessionCookies(c)
+		return newProblem(fiber.StatusUnauthorized, err.Error())
+	}
+	if err != nil {
+		return internalProblem("could not check session", err)
+	}
+
+	if !safeMethod(c.Method()) {
+		header, cookie := c.Get(csrfHeader), c.Cookies(csrfCookie)
+		if header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(cookie)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(hashToken(header)), []byte(session.CSRFTokenHash)) != 1 {
+			return newProblem(fiber.StatusForbidden, "missing or wrong "+csrfHeader+" header")
+		}
+	}
+
+	user, err := getUser(gormdb, int(session.UserID))
+	if errors.Is(err, ErrUserNotFound) {
+		return newProblem(fiber.StatusUnauthorized, ErrInvalidSession.Error())
+	}
+	if err != nil {
+		return internalProblem("could not get user", err)
+	}
+	if user.DisabledAt != nil {
+		return newProblem(fiber.StatusForbidden, ErrAccountDisabled.Error())
+	}
+
+	c.Locals(principalKey, newSessionPrincipal(session, user))
+
+	return c.Next()
+}
+
+// * newSessionPrincipal is the caller behind a session cookie, the user's role is read fresh on every request
+func newSessionPrincipal(session *Session, user *User) *Principal {
+	return &Principal{
+		UserID:    user.ID,
+		Roles:     impliedRoles(user.Role),
+		TokenID:   "session:" + strconv.FormatUint(uint64(session.ID), 10),
+		Scopes:    scopesForRole[user.Role],
+		ExpiresAt: session.ExpiresAt,
+
+		EmailVerified:   user.EmailVerifiedAt != nil,
+		MFA:             session.MFA,
+		CookieSessionID: session.ID,
+	}
+}
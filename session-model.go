@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// * sessionTouchInterval is how often last_seen_at is written per session, the idle timeout is only this exact
+const sessionTouchInterval = time.Minute
+
+// * Session is a browser login in cookie mode, the cookie only holds a random token and only its sha256 is kept.
+// * It ends after sessionIdleTimeout without requests, and after sessionAbsoluteTimeout no matter what.
+type Session struct {
+	ID            uint   `gorm:"primaryKey"`
+	UserID        uint   `gorm:"index;not null"`
+	TokenHash     string `gorm:"uniqueIndex;not null"`
+	CSRFTokenHash string `gorm:"not null"` // * the CSRF token belongs to the session, a token of another session doesn't pass
+	MFA           bool   `gorm:"not null;default:false"`
+	IP            string
+	UserAgent     string
+	LastSeenAt    time.Time
+	ExpiresAt     time.Time `gorm:"index"` // * the absolute timeout
+	RevokedAt     *time.Time
+	CreatedAt     time.Time
+}
+
+type SessionResponse struct {
+	Message   string    `json:"message" example:"Login successful"`
+	CSRFToken string    `json:"csrf_token" example:"q3V0c2lkZV9jc3JmX3Rva2Vu..."` // * send it back in X-CSRF-Token, it is also in the __Host-csrf cookie
+	ExpiresAt time.Time `json:"expires_at" example:"2025-01-03T03:04:05Z"`        // * the absolute timeout, the idle timeout can end it sooner
+}
+
+var ErrInvalidSession = errors.New("invalid or expired session")
+
+// * createSession starts a cookie session, it returns the session token and the CSRF token, neither is stored
+func createSession(db *gorm.DB, user *User, mfa bool, ip, userAgent string) (*Session, string, string, error) {
+	if user.DisabledAt != nil {
+		return nil, "", "", ErrAccountDisabled
+	}
+
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		return nil, "", "", err
+	}
+	csrf, csrfHash, err := newOpaqueToken()
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	now := time.Now()
+	session := &Session{
+		UserID:        user.ID,
+		TokenHash:     tokenHash,
+		CSRFTokenHash: csrfHash,
+		MFA:           mfa,
+		IP:            ip,
+		UserAgent:     truncate(userAgent, 255),
+		LastSeenAt:    now,
+		ExpiresAt:     now.Add(sessionAbsoluteTimeout),
+	}
+	if err := db.Create(session).Error; err != nil {
+		return nil, "", "", err
+	}
+
+	return session, token, csrf, nil
+}
+
+// * authenticateSession finds the live session of a cookie and records that it was used
+func authenticateSession(db *gorm.DB, token string) (*Session, error) {
+	var session Session
+	now := time.Now()
+	result := db.Where("token_hash = ? AND revoked_at IS NULL AND expires_at > ? AND last_seen_at > ?",
+		hashToken(token), now, now.Add(-sessionIdleTimeout)).First(&session)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidSession
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if now.Sub(session.LastSeenAt) >= sessionTouchInterval {
+		err := db.Model(&Session{}).Where("id = ?", session.ID).Update("last_seen_at", now).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &session, nil
+}
+
+func revokeSession(db *gorm.DB, id uint) error {
+	return db.Model(&Session{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now()).Error
+}
+
+// * purgeExpiredSessions drops sessions past their absolute timeout, revoked or idle ones go with them then
+func purgeExpiredSessions(db *gorm.DB) error {
+	return db.Where("expires_at < ?", time.Now()).Delete(&Session{}).Error
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// * Setting is a runtime setting admins can change through the API, one row per key
+type Setting struct {
+	Key       string `gorm:"primaryKey"`
+	Value     string `gorm:"not null"`
+	UpdatedAt time.Time
+	UpdatedBy *uint
+}
+
+const settingMFARequiredRoles = "mfa_required_roles" // * comma separated roles
+
+type MFAPolicyDTO struct {
+	RequiredRoles []string `json:"required_roles" validate:"dive,oneof=reader editor admin" example:"editor,admin"`
+}
+
+type MFAPolicyResponse struct {
+	RequiredRoles []string `json:"required_roles" example:"editor,admin"`
+}
+
+// * mfaPolicy is the in-memory copy of the MFA settings, requireRole reads it on every request
+type mfaPolicyCache struct {
+	mu    sync.RWMutex
+	roles map[string]bool
+}
+
+var mfaPolicy = new(mfaPolicyCache)
+
+func (p *mfaPolicyCache) requires(role string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.roles[role]
+}
+
+func (p *mfaPolicyCache) list() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	roles := []string{}
+	for _, r := range []string{RoleReader, RoleEditor, RoleAdmin} {
+		if p.roles[r] {
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
+
+func (p *mfaPolicyCache) set(roles []string) {
+	set := make(map[string]bool, len(roles))
+	for _, r := range roles {
+		set[r] = true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.roles = set
+}
+
+func getSetting(db *gorm.DB, key string) (string, error) {
+	var setting Setting
+	result := db.Where("key = ?", key).First(&setting)
+
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	return setting.Value, result.Error
+}
+
+func putSetting(db *gorm.DB, key, value string, updatedBy *uint) error {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "updated_at", "updated_by"}),
+	}).Create(&Setting{Key: key, Value: value, UpdatedBy: updatedBy}).Error
+}
+
+func loadMFAPolicy(db *gorm.DB) error {
+	value, err := getSetting(db, settingMFARequiredRoles)
+	if err != nil {
+		return err
+	}
+
+	var roles []string
+	for _, r := range strings.Split(value, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			roles = append(roles, r)
+		}
+	}
+	mfaPolicy.set(roles)
+
+	return nil
+}
+
+func updateMFAPolicy(db *gorm.DB, roles []string, updatedBy *uint) error {
+	if err := putSetting(db, settingMFARequiredRoles, strings.Join(roles, ","), updatedBy); err != nil {
+		return err
+	}
+	mfaPolicy.set(roles)
+	return nil
+}
+
+// * watchMFAPolicy reloads the policy, so a change made on one server reaches the others
+func watchMFAPolicy(db *gorm.DB, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := loadMFAPolicy(db); err != nil {
+				log.Printf("Error reload MFA policy: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// * loginThrottle is one counter a failed login is charged to, with the failures it gets for free
+type loginThrottle struct {
+	key  string
+	free int
+}
+
+// * throttleProblem turns a lockout into 429 with Retry-After, other errors into 500
+func throttleProblem(c *fiber.Ctx, err error) error {
+	var locked *LoginLockedError
+	if errors.As(err, &locked) {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(locked.RetryAfter.Seconds())+1))
+		return newProblem(fiber.StatusTooManyRequests, locked.Error())
+	}
+	return internalProblem("could not check login throttle", err)
+}
+
+// * checkThrottles fails with 429 while any of the throttles is locked out
+func checkThrottles(c *fiber.Ctx, throttles ...loginThrottle) error {
+	keys := make([]string, len(throttles))
+	for i, t := range throttles {
+		keys[i] = t.key
+	}
+
+	if err := checkLoginThrottle(gormdb, keys...); err != nil {
+		return throttleProblem(c, err)
+	}
+	return nil
+}
+
+// * recordFailedLogin charges a failure to every throttle and audits the ones that just got locked out
+func recordFailedLogin(c *fiber.Ctx, throttles ...loginThrottle) error {
+	for _, t := range throttles {
+		lockout, failures, err := recordLoginFailure(gormdb, t.key, t.free)
+		if err != nil {
+			return internalProblem("could not record failed login", err)
+		}
+		if lockout > 0 {
+			recordAudit(c, AuditEvent{
+				Action:  "login.locked",
+				Subject: t.key,
+				Details: map[string]interface{}{
+					"failures":     failures,
+					"locked_until": time.Now().Add(lockout).UTC(),
+				},
+			})
+		}
+	}
+	return nil
+}
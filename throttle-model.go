@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// * LoginThrottle counts recent failed logins for one account or one client IP
+type LoginThrottle struct {
+	Key           string `gorm:"primaryKey"` // * "account:<email>" or "ip:<address>"
+	Failures      int    `gorm:"not null;default:0"`
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+const (
+	accountFreeFailures = 5  // * failures an account gets before lockouts start
+	ipFreeFailures      = 20 // * an IP tries many accounts when stuffing credentials, but so can a busy NAT
+	loginLockoutBase    = time.Minute
+	loginLockoutMax     = time.Hour
+	loginFailureWindow  = time.Hour // * failures older than this are forgotten
+
+	passwordResetFreeRequests = 3 // * reset emails an address gets within loginFailureWindow before lockouts start
+)
+
+// * LoginLockedError is returned while an account or IP is locked out
+type LoginLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginLockedError) Error() string {
+	return fmt.Sprintf("too many attempts, try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+func accountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// * the reset throttles have their own keys, a reset flood shouldn't lock anybody out of logging in
+func passwordResetThrottleKey(email string) string {
+	return "reset:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func passwordResetIPThrottleKey(ip string) string {
+	return "reset-ip:" + ip
+}
+
+// * lockoutFor doubles the lockout with every failure past the free ones: 1m, 2m, 4m, ... up to an hour
+func lockoutFor(failures, free int) time.Duration {
+	if failures < free {
+		return 0
+	}
+
+	lockout := loginLockoutBase
+	for i := free; i < failures && lockout < loginLockoutMax; i++ {
+		lockout *= 2
+	}
+	return min(lockout, loginLockoutMax)
+}
+
+// * checkLoginThrottle returns a *LoginLockedError when any of the keys is locked out
+func checkLoginThrottle(db *gorm.DB, keys ...string) error {
+	var lockedUntil *time.Time
+	result := db.Model(&LoginThrottle{}).
+		Where("key IN ? AND locked_until > ?", keys, time.Now()).
+		Select("max(locked_until)").Scan(&lockedUntil)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if lockedUntil != nil {
+		return &LoginLockedError{RetryAfter: time.Until(*lockedUntil)}
+	}
+	return nil
+}
+
+// * recordLoginFailure counts a failure for key and locks it out once it is past free failures.
+// * It returns how long key is now locked out, 0 when it isn't.
+func recordLoginFailure(db *gorm.DB, key string, free int) (time.Duration, int, error) {
+	now := time.Now()
+
+	// * one statement, so concurrent failures can't overwrite each other's count
+	var failures int
+	result := db.Raw(`INSERT INTO login_throttles (key, failures, last_failure_at) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_throttles.last_failure_at < ? THEN 1 ELSE login_throttles.failures + 1 END,
+			last_failure_at = EXCLUDED.last_failure_at
+		RETURNING failures`,
+		key, now, now.Add(-loginFailureWindow)).Scan(&failures)
+	if result.Error != nil {
+		return 0, 0, result.Error
+	}
+
+	lockout := lockoutFor(failures, free)
+	if lockout == 0 {
+		return 0, failures, nil
+	}
+
+	err := db.Model(&LoginThrottle{}).Where("key = ?", key).Update("locked_until", now.Add(lockout)).Error
+	return lockout, failures, err
+}
+
+// * resetLoginFailures forgets the failures of key after a successful login
+func resetLoginFailures(db *gorm.DB, key string) error {
+	return db.Where("key = ?", key).Delete(&LoginThrottle{}).Error
+}
+
+func purgeLoginThrottles(db *gorm.DB) error {
+	now := time.Now()
+	return db.Where("last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)", now.Add(-loginFailureWindow), now).
+		Delete(&LoginThrottle{}).Error
+}
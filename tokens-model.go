@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// * RefreshToken is one link of a rotation chain, every token of a login shares the FamilyID.
+// * Only the sha256 of the token is stored.
+type RefreshToken struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index;not null"`
+	FamilyID  string `gorm:"index;not null"`
+	TokenHash string `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time
+	MFA       bool       `gorm:"not null;default:false"` // * the login passed a second factor, the rotated tokens inherit it
+	ClientID  string     `gorm:"index"`                  // * the OAuth client the tokens were issued to, empty for our own logins
+	Scope     string     // * the scope granted to ClientID
+	UsedAt    *time.Time // * set when the token was exchanged for a new pair
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// * RevokedToken is the deny list of access tokens by jti, rows can go once the token has expired anyway
+type RevokedToken struct {
+	JTI       string    `gorm:"primaryKey"`
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
+
+type RefreshDTO struct {
+	RefreshToken string `json:"refresh_token" validate:"required" example:"6fJp1mB0c1Vd6O2m..."`
+}
+
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int64  // * seconds until the access token expires
+	Scope        string // * what an OAuth client's tokens were granted, empty for our own logins
+	UserID       uint
+	FamilyID     string
+}
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used, all sessions of this login were revoked")
+)
+
+// * newOpaqueToken returns a random token for the client and the hash we keep
+func newOpaqueToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// * impersonationTTL caps impersonation tokens, there is no refresh token to extend them
+const impersonationTTL = 15 * time.Minute
+
+// * newImpersonationToken is an access token for user that names the admin behind it in its act claim
+func newImpersonationToken(user *User, impersonator *Principal) (string, int64, error) {
+	now := time.Now()
+	ttl := min(accessTokenTTL, impersonationTTL)
+
+	// * its own family, without refresh tokens, so ending the user's sessions doesn't end it and vice versa
+	claims := newAccessClaims(user, uuid.NewString(), uuid.NewString(), impersonator.MFA, now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+	claims.Act = &ActorClaim{Subject: strconv.FormatUint(uint64(impersonator.UserID), 10)}
+
+	token, err := signingKeys.sign(claims)
+	return token, int64(ttl / time.Second), err
+}
+
+func newAccessToken(user *User, familyID, clientID, scope string, mfa bool) (string, error) {
+	claims := newAccessClaims(user, familyID, uuid.NewString(), mfa, time.Now())
+	if clientID != "" {
+		claims.ClientID, claims.Scope = clientID, scope
+	}
+	return signingKeys.sign(claims)
+}
+
+// * issueTokens creates an access token and a refresh token, an empty familyID starts a new family (a new login).
+// * mfa says whether the login passed a second factor.
+func issueTokens(db *gorm.DB, user *User, familyID string, mfa bool) (*TokenPair, error) {
+	return issueScopedTokens(db, user, "", "", familyID, mfa)
+}
+
+// * issueScopedTokens is issueTokens for an OAuth client, the tokens carry its client_id and only the granted scope
+func issueScopedTokens(db *gorm.DB, user *User, clientID, scope, familyID string, mfa bool) (*TokenPair, error) {
+	if user.DisabledAt != nil {
+		return nil, ErrAccountDisabled
+	}
+	if familyID == "" {
+		familyID = uuid.NewString()
+	}
+
+	refresh, hash, err := newOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	result := db.Create(&RefreshToken{
+		UserID:    user.ID,
+		FamilyID:  familyID,
+		TokenHash: hash,
+		MFA:       mfa,
+		ClientID:  clientID,
+		Scope:     scope,
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	access, err := newAccessToken(user, familyID, clientID, scope, mfa)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresIn:    int64(accessTokenTTL / time.Second),
+		Scope:        scope,
+		UserID:       user.ID,
+		FamilyID:     familyID,
+	}, nil
+}
+
+// * rotateRefreshToken trades a refresh token for a new pair. A token can be traded once, seeing it a second
+// * time means it was stolen (or the client is broken), so the whole family is revoked.
+// * clientID is the OAuth client asking, empty at POST /token/refresh, a token only works for the client it was issued to.
+func rotateRefreshToken(db *gorm.DB, raw, clientID string) (*TokenPair, error) {
+	var stored RefreshToken
+	result := db.Where("token_hash = ?", hashToken(raw)).First(&stored)
+
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if stored.ClientID != clientID {
+		return nil, ErrInvalidRefreshToken
+	}
+	if stored.UsedAt != nil {
+		if err := revokeTokenFamily(db, stored.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if stored.RevokedAt != nil || time.Now().After(stored.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	// * only one of two concurrent refreshes with the same token can win this update
+	result = db.Model(&RefreshToken{}).
+		Where("id = ? AND used_at IS NULL", stored.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		if err := revokeTokenFamily(db, stored.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	user, err := getUser(db, int(stored.UserID))
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scope := stored.Scope
+	if clientID != "" {
+		// * a user who lost a role since the consent loses its scopes here too
+		scope = strings.Join(grantedScopes(stored.Scope, user.Role), " ")
+		if scope == "" {
+			return nil, ErrInvalidRefreshToken
+		}
+	}
+
+	return issueScopedTokens(db, user, clientID, scope, stored.FamilyID, stored.MFA)
+}
+
+func revokeTokenFamily(db *gorm.DB, familyID string) error {
+	return db.Model(&RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// * revokeUserSessions logs a user out of every login, their access tokens die with their families
+func revokeUserSessions(db *gorm.DB, userID uint) error {
+	err := db.Model(&RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+	if err != nil {
+		return err
+	}
+	return db.Model(&Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+func revokeAccessToken(db *gorm.DB, jti string, expiresAt time.Time) error {
+	return db.Create(&RevokedToken{JTI: jti, ExpiresAt: expiresAt}).Error
+}
+
+// * tokenRevoked reports whether an access token was revoked by itself (logout) or through its family (reuse, logout)
+func tokenRevoked(db *gorm.DB, jti, familyID string) (bool, error) {
+	var revoked bool
+	result := db.Raw(`SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = ?)
+		OR EXISTS (SELECT 1 FROM refresh_tokens WHERE family_id = ? AND revoked_at IS NOT NULL)`,
+		jti, familyID).Scan(&revoked)
+
+	return revoked, result.Error
+}
+
+// * accountDisabled reports whether the user was disabled or deleted since their token was issued
+func accountDisabled(db *gorm.DB, userID uint) (bool, error) {
+	var active bool
+	result := db.Raw(`SELECT EXISTS (SELECT 1 FROM users WHERE id = ? AND deleted_at IS NULL AND disabled_at IS NULL)`,
+		userID).Scan(&active)
+
+	return !active, result.Error
+}
+
+// * purgeExpiredTokens drops rows that can no longer matter, every token they describe has expired
+func purgeExpiredTokens(db *gorm.DB) error {
+	now := time.Now()
+
+	if err := db.Where("expires_at < ?", now).Delete(&RevokedToken{}).Error; err != nil {
+		return err
+	}
+	if err := purgeExpiredResetTokens(db); err != nil {
+		return err
+	}
+	if err := purgeLoginThrottles(db); err != nil {
+		return err
+	}
+	if err := purgeExpiredOIDCStates(db); err != nil {
+		return err
+	}
+	if err := purgeExpiredAuthorizationCodes(db); err != nil {
+		return err
+	}
+	if err := purgeExpiredSessions(db); err != nil {
+		return err
+	}
+	// * a family's revocation must outlive its access tokens, hence the extra access TTL
+	return db.Where("expires_at < ?", now.Add(-accessTokenTTL)).Delete(&RefreshToken{}).Error
+}
+
+func startTokenJanitor(db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := purgeExpiredTokens(db); err != nil {
+				log.Printf("Error purge expired tokens: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// * userProblem maps the errors of the user model functions to the matching problem
+func userProblem(err error, detail string) error {
+	if errors.Is(err, ErrUserNotFound) {
+		return newProblem(fiber.StatusNotFound, err.Error())
+	}
+	return internalProblem(detail, err)
+}
+
+// @Summary Change user role
+// @Description Set a user's role (admin only). Roles are ordered reader < editor < admin:
+// @Description readers can read books, editors can also create, update and delete them, admins can also manage users and the trash.
+// @Tags users
+// @Accept  json
+// @Produce  json
+// @Security ApiKeyAuth
+// @x-required-role "admin"
+// @Param userID path int true "User ID"
+// @Param Role body RoleDTO true "Role DTO"
+// @Success 200 {object} UserResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 404 {object} Problem "Not Found"
+// @Failure 409 {object} Problem "Conflict"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /users/{userID}/role [put]
+func UpdateUserRole(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, "user id must be an integer")
+	}
+
+	dto := new(RoleDTO)
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid request body")
+	}
+	if err := validateStruct(dto); err != nil {
+		return err
+	}
+
+	// * an admin demoting themselves could leave nobody able to manage users
+	if uint(id) == currentUserID(c) && dto.Role != RoleAdmin {
+		return newProblem(fiber.StatusConflict, "admins cannot remove their own admin role")
+	}
+
+	before, err := getUser(gormdb, id)
+	if err != nil {
+		return userProblem(err, "could not get user")
+	}
+
+	if err := updateUserRole(gormdb, id, dto.Role); err != nil {
+		return userProblem(err, "could not update role")
+	}
+
+	user, err := getUser(gormdb, id)
+	if err != nil {
+		return userProblem(err, "could not get user")
+	}
+	if user.Role != before.Role {
+		recordAudit(c, AuditEvent{
+			Action:  "user.role_changed",
+			Subject: userSubject(id),
+			Before:  map[string]interface{}{"role": before.Role},
+			After:   map[string]interface{}{"role": user.Role},
+		})
+	}
+
+	return c.JSON(newUserResponse(user))
+}
+
+// * targetUserID reads :id and refuses the caller's own id, for actions an admin must not take on themselves
+func targetUserID(c *fiber.Ctx, action string) (int, error) {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return 0, newProblem(fiber.StatusBadRequest, "user id must be an integer")
+	}
+	if uint(id) == currentUserID(c) {
+		return 0, newProblem(fiber.StatusConflict, "admins cannot "+action+" themselves")
+	}
+	return id, nil
+}
+
+func userSubject(id int) string {
+	return "user:" + strconv.Itoa(id)
+}
+
+// @Summary List users
+// @Description List users, oldest first, optionally filtered (admin only)
+// @Tags users
+// @Produce  json
+// @Security ApiKeyAuth
+// @x-required-role "admin"
+// @Param q query string false "Part of the email or display name"
+// @Param role query string false "Role" Enums(reader, editor, admin)
+// @Param disabled query bool false "Only disabled (true) or enabled (false) users"
+// @Param page query int false "Page number, starting at 1" minimum(1) maximum(21474836) default(1)
+// @Param limit query int false "Items per page" minimum(1) maximum(100) default(20)
+// @Success 200 {object} UserPage
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /users [get]
+func GetUsers(c *fiber.Ctx) error {
+	page, limit, err := parsePageLimit(c)
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, err.Error())
+	}
+
+	q := UserQuery{Search: strings.TrimSpace(c.Query("q")), Role: c.Query("role"), Page: page, Limit: limit}
+	if q.Role != "" && roleRank[q.Role] == 0 {
+		return newProblem(fiber.StatusBadRequest, "role must be one of: reader editor admin")
+	}
+	if v := c.Query("disabled"); v != "" {
+		disabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return newProblem(fiber.StatusBadRequest, "disabled must be true or false")
+		}
+		q.Disabled = &disabled
+	}
+
+	users, total, err := getUsers(gormdb, q)
+	if err != nil {
+		return internalProblem("could not get users", err)
+	}
+
+	result := UserPage{
+		Items: newUserResponses(users),
+		Total: total,
+		Page:  page,
+		Limit: limit,
+	}
+	if int64(page*limit) < total {
+		result.Links.Next = pageLink(c, map[string]string{"page": strconv.Itoa(page + 1)})
+	}
+	if page > 1 {
+		result.Links.Prev = pageLink(c, map[string]string{"page": strconv.Itoa(page - 1)})
+	}
+
+	return c.JSON(result)
+}
+
+// @Summary Get user
+// @Description Get a user by id (admin only)
+// @Tags users
+// @Produce  json
+// @Security ApiKeyAuth
+// @x-required-role "admin"
+// @Param userID path int true "User ID"
+// @Success 200 {object} UserResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 404 {object} Problem "Not Found"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /users/{userID} [get]
+func GetUser(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, "user id must be an integer")
+	}
+
+	user, err := getUser(gormdb, id)
+	if err != nil {
+		return userProblem(err, "could not get user")
+	}
+
+	return c.JSON(newUserResponse(user))
+}
+
+// * setDisabled is DisableUser and EnableUser
+func setDisabled(c *fiber.Ctx, disabled bool) error {
+	action := "enable"
+	if disabled {
+		action = "disable"
+	}
+
+	id, err := targetUserID(c, action)
+	if err != nil {
+		return err
+	}
+
+	if err := setUserDisabled(gormdb, id, disabled); err != nil {
+		return userProblem(err, "could not "+action+" user")
+	}
+	recordAudit(c, AuditEvent{Action: "user." + action + "d", Subject: userSubject(id)})
+
+	user, err := getUser(gormdb, id)
+	if err != nil {
+		return userProblem(err, "could not get user")
+	}
+
+	return c.JSON(newUserResponse(user))
+}
+
+// @Summary Disable user
+// @Description Disable an account (admin only): the user is logged out everywhere, can't log in, and tokens
+// @Description they still hold are refused with 403.
+// @Tags users
+// @Produce  json
+// @Security ApiKeyAuth
+// @x-required-role "admin"
+// @Param userID path int true "User ID"
+// @Success 200 {object} UserResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 404 {object} Problem "Not Found"
+// @Failure 409 {object} Problem "Conflict"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /users/{userID}/disable [post]
+func DisableUser(c *fiber.Ctx) error {
+	return setDisabled(c, true)
+}
+
+// @Summary Enable user
+// @Description Enable a disabled account again (admin only), the user has to log in again
+// @Tags users
+// @Produce  json
+// @Security ApiKeyAuth
+// @x-required-role "admin"
+// @Param userID path int true "User ID"
+// @Success 200 {object} UserResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 404 {object} Problem "Not Found"
+// @Failure 409 {object} Problem "Conflict"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /users/{userID}/enable [post]
+func EnableUser(c *fiber.Ctx) error {
+	return setDisabled(c, false)
+}
+
+// @Summary Force password reset
+// @Description Log the user out everywhere and refuse their password until they set a new one (admin only).
+// @Description They are mailed a reset token for POST /password/reset.
+// @Tags users
+// @Produce  json
+// @Security ApiKeyAuth
+// @x-required-role "admin"
+// @Param userID path int true "User ID"
+// @Success 202 {object} MessageResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 404 {object} Problem "Not Found"
+// @Failure 409 {object} Problem "Conflict"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /users/{userID}/password-reset [post]
+func ForcePasswordReset(c *fiber.Ctx) error {
+	id, err := targetUserID(c, "force a password reset on")
+	if err != nil {
+		return err
+	}
+
+	token, user, err := requirePasswordReset(gormdb, id)
+	if err != nil {
+		return userProblem(err, "could not force password reset")
+	}
+	recordAudit(c, AuditEvent{Action: "user.password_reset_forced", Subject: userSubject(id)})
+
+	sendMail(passwordResetMail(user, token))
+
+	return c.Status(fiber.StatusAccepted).JSON(MessageResponse{
+		Message: "Password reset required, the user was mailed a reset token",
+	})
+}
+
+type ImpersonationResponse struct {
+	Message        string       `json:"message" example:"Impersonating user 7"`
+	Token          string       `json:"Token" example:"eyJhbGciOiJSUzI1NiIsImtpZCI6..."`
+	ExpiresIn      int64        `json:"expires_in" example:"900"` // * seconds until Token expires, it can't be refreshed
+	ImpersonatorID uint         `json:"impersonator_id" example:"1"`
+	User           UserResponse `json:"user"`
+}
+
+// @Summary Impersonate user
+// @Description Get an access token that acts as the user (admin only), to see the API as they do.
+// @Description The token names the admin in its act claim, responses to it carry X-Impersonated-By, it can't be refreshed,
+// @Description and every impersonation is audited. Admins and disabled users can't be impersonated.
+// @Tags users
+// @Produce  json
+// @Security ApiKeyAuth
+// @x-required-role "admin"
+// @Param userID path int true "User ID"
+// @Success 200 {object} ImpersonationResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 403 {object} Problem "Forbidden"
+// @Failure 404 {object} Problem "Not Found"
+// @Failure 409 {object} Problem "Conflict"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /users/{userID}/impersonate [post]
+func ImpersonateUser(c *fiber.Ctx) error {
+	id, err := targetUserID(c, "impersonate")
+	if err != nil {
+		return err
+	}
+
+	principal := currentPrincipal(c)
+	if principal.ImpersonatorID != 0 {
+		return newProblem(fiber.StatusForbidden, "an impersonation token can't impersonate")
+	}
+
+	user, err := getUser(gormdb, id)
+	if err != nil {
+		return userProblem(err, "could not get user")
+	}
+	if user.Role == RoleAdmin {
+		return newProblem(fiber.StatusForbidden, "admins can't be impersonated")
+	}
+	if user.DisabledAt != nil {
+		return newProblem(fiber.StatusConflict, ErrAccountDisabled.Error())
+	}
+
+	token, expiresIn, err := newImpersonationToken(user, principal)
+	if err != nil {
+		return internalProblem("could not create impersonation token", err)
+	}
+	recordAudit(c, AuditEvent{
+		Action:  "user.impersonated",
+		Subject: userSubject(id),
+		Details: map[string]interface{}{"expires_in": expiresIn},
+	})
+
+	return c.JSON(ImpersonationResponse{
+		Message:        "Impersonating user " + strconv.Itoa(id),
+		Token:          token,
+		ExpiresIn:      expiresIn,
+		ImpersonatorID: principal.UserID,
+		User:           newUserResponse(user),
+	})
+}
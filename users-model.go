@@ -1,23 +1,135 @@
 package main
 
 import (
-	"os"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
-	"github.com/golang-jwt/jwt/v4"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
+// * roles are ordered, every role can do everything the roles before it can
+const (
+	RoleReader = "reader"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+var roleRank = map[string]int{
+	RoleReader: 1,
+	RoleEditor: 2,
+	RoleAdmin:  3,
+}
+
+var ErrUserNotFound = errors.New("user not found")
+
 type User struct {
 	gorm.Model
-	Email string `gorm:"unique" json:"email"`
-	Password string `json:"password"`
+	Email                 string     `gorm:"not null" json:"email"` // * unique among users that aren't deleted, see migrateUserEmailIndex
+	Password              string     `json:"-"`                     // * bcrypt hash, never serialized
+	Role                  string     `gorm:"not null;default:reader" json:"role"`
+	EmailVerifiedAt       *time.Time `json:"email_verified_at"` // * nil until the link from the verification email is opened
+	VerificationSentAt    *time.Time `json:"-"`
+	MFAEnabledAt          *time.Time `json:"mfa_enabled_at"` // * set once a TOTP code was confirmed, logins then need a second step
+	TOTPSecret            string     `json:"-"`
+	TOTPLastStep          int64      `gorm:"not null;default:0" json:"-"` // * time step of the last accepted code, a code works once
+	DisplayName           string     `json:"display_name"`
+	AvatarURL             string     `json:"avatar_url"`
+	Locale                string     `gorm:"not null;default:en" json:"locale"`
+	PendingEmail          *string    `json:"pending_email"`                                         // * requested new email, it replaces Email once it is verified
+	DisabledAt            *time.Time `json:"disabled_at"`                                           // * disabled by an admin, nothing works until they enable the account again
+	PasswordResetRequired bool       `gorm:"not null;default:false" json:"password_reset_required"` // * set by an admin, login is refused until POST /password/reset
 }
 
 type UserDTO struct {
-	Email    string `gorm:"unique" json:"email" example:"user@example.com"`
-	Password string `json:"password" example:"securePassword123"`
+	Email    string `json:"email" validate:"required,email,max=254" example:"user@example.com" maxLength:"254"`
+	Password string `json:"password" validate:"required,min=8,maxbytes=72,password" example:"securePassword123" minLength:"8" maxLength:"72"` // * bcrypt refuses passwords over 72 bytes
+}
+
+type LoginDTO struct {
+	Email    string `json:"email" validate:"required,email" example:"user@example.com"`
+	Password string `json:"password" validate:"required" example:"securePassword123"`
+}
+
+// * ProfileDTO is the part of a user the user edits themselves, the document PATCH /me is applied to
+type ProfileDTO struct {
+	DisplayName string `json:"display_name" validate:"max=100" example:"Jane Doe" maxLength:"100"`
+	AvatarURL   string `json:"avatar_url" validate:"omitempty,http_url,max=2048" example:"https://example.com/jane.png" maxLength:"2048"`
+	Locale      string `json:"locale" validate:"required,bcp47_language_tag,max=35" example:"en-US" maxLength:"35"`
+}
+
+type ChangePasswordDTO struct {
+	CurrentPassword string `json:"current_password" validate:"required" example:"securePassword123"`
+	NewPassword     string `json:"new_password" validate:"required,min=8,maxbytes=72,password" example:"newSecurePassword123" minLength:"8" maxLength:"72"`
+}
+
+type ChangeEmailDTO struct {
+	Email    string `json:"email" validate:"required,email,max=254" example:"new@example.com" maxLength:"254"`
+	Password string `json:"password" validate:"required" example:"securePassword123"`
+}
+
+type DeleteAccountDTO struct {
+	Password string `json:"password" validate:"required" example:"securePassword123"`
+}
+
+type RoleDTO struct {
+	Role string `json:"role" validate:"required,oneof=reader editor admin" example:"editor" enums:"reader,editor,admin"`
+}
+
+type UserResponse struct {
+	ID            uint       `json:"id" example:"1"`
+	Email         string     `json:"email" example:"user@example.com"`
+	Role          string     `json:"role" example:"reader" enums:"reader,editor,admin"`
+	EmailVerified bool       `json:"email_verified" example:"true"`
+	MFAEnabled    bool       `json:"mfa_enabled" example:"false"`
+	DisplayName   string     `json:"display_name" example:"Jane Doe"`
+	AvatarURL     string     `json:"avatar_url" example:"https://example.com/jane.png"`
+	Locale        string     `json:"locale" example:"en-US"`
+	PendingEmail  *string    `json:"pending_email,omitempty" example:"new@example.com"`
+	DisabledAt    *time.Time `json:"disabled_at,omitempty" example:"2025-01-03T10:00:00Z"`
+	CreatedAt     time.Time  `json:"created_at" example:"2025-01-02T15:04:05Z"`
+}
+
+type TokenResponse struct {
+	Message      string `json:"message" example:"Login successful"`
+	Token        string `json:"Token" example:"eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9..."`
+	RefreshToken string `json:"refresh_token" example:"6fJp1mB0c1Vd6O2m..."`
+	ExpiresIn    int64  `json:"expires_in" example:"900"` // * seconds until Token expires
+}
+
+func newTokenResponse(message string, pair *TokenPair) TokenResponse {
+	return TokenResponse{
+		Message:      message,
+		Token:        pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
+		ExpiresIn:    pair.ExpiresIn,
+	}
+}
+
+// * toUser copies the credentials into a new User, the password is hashed by createUser
+func (dto *UserDTO) toUser() *User {
+	return &User{
+		Email:    dto.Email,
+		Password: dto.Password,
+	}
+}
+
+func newUserResponse(user *User) UserResponse {
+	return UserResponse{
+		ID:            user.ID,
+		Email:         user.Email,
+		Role:          user.Role,
+		EmailVerified: user.EmailVerifiedAt != nil,
+		MFAEnabled:    user.MFAEnabledAt != nil,
+		DisplayName:   user.DisplayName,
+		AvatarURL:     user.AvatarURL,
+		Locale:        user.Locale,
+		PendingEmail:  user.PendingEmail,
+		DisabledAt:    user.DisabledAt,
+		CreatedAt:     user.CreatedAt,
+	}
 }
 
 func createUser(db *gorm.DB, user *User) error {
@@ -37,33 +149,311 @@ func createUser(db *gorm.DB, user *User) error {
 	return nil
 }
 
-func loginUser(db *gorm.DB, user *User) (string,error) {
+var (
+	ErrInvalidCredentials    = errors.New("invalid email or password")
+	ErrAccountDisabled       = errors.New("account is disabled")
+	ErrPasswordResetRequired = errors.New("a password reset is required, use POST /password/forgot")
+)
+
+// * dummyPasswordHash is compared against when the email is unknown, so that case takes as long as a wrong password
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// * loginUser checks the credentials and returns the user, the caller then issues tokens or a session
+func loginUser(db *gorm.DB, credentials *LoginDTO) (*User, error) {
 	// * get user from email
 	selectedUser := new(User)
-	result := db.Where("email = ?", user.Email).First(selectedUser)
+	result := db.Where("email = ?", credentials.Email).First(selectedUser)
 
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(credentials.Password))
+		return nil, ErrInvalidCredentials
+	}
 	if result.Error != nil {
-		return "", result.Error
+		return nil, result.Error
 	}
 
 	// * compare password
-	err := bcrypt.CompareHashAndPassword([]byte(selectedUser.Password), []byte(user.Password))
+	err := bcrypt.CompareHashAndPassword([]byte(selectedUser.Password), []byte(credentials.Password))
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if selectedUser.PasswordResetRequired {
+		return nil, ErrPasswordResetRequired
+	}
+	if selectedUser.DisabledAt != nil {
+		return nil, ErrAccountDisabled
+	}
+
+	// * the password was right, with MFA the caller gets a challenge for POST /login/mfa instead of tokens
+	if selectedUser.MFAEnabledAt != nil {
+		challenge, err := newMFAChallenge(selectedUser)
+		if err != nil {
+			return nil, err
+		}
+		return nil, challenge
+	}
+
+	return selectedUser, nil
+}
+
+// * migrateRoles moves users from before roles existed, who could edit every book, to the editor role.
+// * main calls it before AutoMigrate, so it can tell the run that adds the role column apart.
+func migrateRoles(db *gorm.DB) error {
+	// * a new database gets the column from AutoMigrate, a migrated one already has it
+	if !db.Migrator().HasTable(&User{}) || db.Migrator().HasColumn(&User{}, "Role") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Migrator().AddColumn(&User{}, "Role"); err != nil {
+			return err
+		}
+		// * every row got the column default, reader
+		return tx.Model(&User{}).Where("role = ?", RoleReader).Update("role", RoleEditor).Error
+	})
+}
+
+func getUser(db *gorm.DB, id int) (*User, error) {
+	var user User
+	result := db.First(&user, id)
+
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	}
+	if result.Error != nil {
+		return nil, fmt.Errorf("get user %d: %w", id, result.Error)
+	}
+
+	return &user, nil
+}
+
+func updateUserRole(db *gorm.DB, id int, role string) error {
+	result := db.Model(&User{}).Where("id = ?", id).Update("role", role)
+
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// * promoteAdmin gives the admin role to an existing user, used to bootstrap the first admin from ADMIN_EMAIL
+func promoteAdmin(db *gorm.DB, email string) error {
+	return db.Model(&User{}).Where("email = ?", email).Update("role", RoleAdmin).Error
+}
+
+var (
+	ErrWrongPassword = errors.New("current password is wrong")
+	ErrEmailTaken    = errors.New("email is already registered")
+)
+
+// * migrateUserEmailIndex replaces the unique constraint on email with a unique index over the users that aren't
+// * deleted, so a deleted account's email can register again
+func migrateUserEmailIndex(db *gorm.DB) error {
+	for _, constraint := range []string{"uni_users_email", "users_email_key"} {
+		if err := db.Exec("ALTER TABLE users DROP CONSTRAINT IF EXISTS " + constraint).Error; err != nil {
+			return err
+		}
+	}
+	return db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_active ON users (email) WHERE deleted_at IS NULL").Error
+}
+
+func newProfileDTO(user *User) *ProfileDTO {
+	return &ProfileDTO{
+		DisplayName: user.DisplayName,
+		AvatarURL:   user.AvatarURL,
+		Locale:      user.Locale,
+	}
+}
+
+func updateProfile(db *gorm.DB, id uint, profile *ProfileDTO) error {
+	result := db.Model(&User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"display_name": profile.DisplayName,
+		"avatar_url":   profile.AvatarURL,
+		"locale":       profile.Locale,
+	})
+
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+func checkPassword(user *User, password string) error {
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// * changePassword sets a new password and logs out every other login of the user, keepFamilyID stays logged in
+func changePassword(db *gorm.DB, user *User, dto *ChangePasswordDTO, keepFamilyID string, keepSessionID uint) error {
+	if err := checkPassword(user, dto.CurrentPassword); err != nil {
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(dto.NewPassword), bcrypt.DefaultCost)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	// * return jwt
-  // * Create JWT token
-	jwtSecretKey := os.Getenv("JWT_SECRET_KEY")
-  token := jwt.New(jwt.SigningMethodHS256)
-  claims := token.Claims.(jwt.MapClaims)
-  claims["user_id"] = selectedUser.ID
-  claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&User{}).Where("id = ?", user.ID).Update("password", string(hashedPassword)).Error; err != nil {
+			return err
+		}
+		err := tx.Model(&RefreshToken{}).
+			Where("user_id = ? AND family_id <> ? AND revoked_at IS NULL", user.ID, keepFamilyID).
+			Update("revoked_at", time.Now()).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&Session{}).
+			Where("user_id = ? AND id <> ? AND revoked_at IS NULL", user.ID, keepSessionID).
+			Update("revoked_at", time.Now()).Error
+	})
+}
 
-  t, err := token.SignedString([]byte(jwtSecretKey))
-  if err != nil {
-    return "", err
-  }
+// * requestEmailChange stores the new email as pending, it replaces the current one once it is verified
+func requestEmailChange(db *gorm.DB, user *User, dto *ChangeEmailDTO) error {
+	if err := checkPassword(user, dto.Password); err != nil {
+		return err
+	}
 
-	return t, nil
-}
\ No newline at end of file
+	var taken int64
+	if err := db.Model(&User{}).Where("email = ?", dto.Email).Count(&taken).Error; err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrEmailTaken
+	}
+
+	if err := db.Model(&User{}).Where("id = ?", user.ID).Update("pending_email", dto.Email).Error; err != nil {
+		return err
+	}
+	user.PendingEmail = &dto.Email
+
+	return nil
+}
+
+// * deleteAccount soft-deletes the user and logs them out everywhere
+func deleteAccount(db *gorm.DB, user *User, password string) error {
+	if err := checkPassword(user, password); err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&User{}, user.ID).Error; err != nil {
+			return err
+		}
+		return revokeUserSessions(tx, user.ID)
+	})
+}
+
+type UserPage struct {
+	Items []UserResponse `json:"items"`
+	Total int64          `json:"total" example:"42"`
+	Page  int            `json:"page" example:"1"`
+	Limit int            `json:"limit" example:"20"`
+	Links PageLinks      `json:"links"`
+}
+
+// * UserQuery filters the admin user list, zero values mean no filter
+type UserQuery struct {
+	Search   string // * part of the email or display name
+	Role     string
+	Disabled *bool
+	Page     int
+	Limit    int
+}
+
+func newUserResponses(users []User) []UserResponse {
+	responses := make([]UserResponse, 0, len(users))
+	for i := range users {
+		responses = append(responses, newUserResponse(&users[i]))
+	}
+	return responses
+}
+
+// * getUsers lists users for admins, oldest first
+func getUsers(db *gorm.DB, q UserQuery) ([]User, int64, error) {
+	var users []User
+	var total int64
+
+	tx := db.Model(&User{})
+	if q.Search != "" {
+		escaped := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q.Search) + "%"
+		tx = tx.Where("email ILIKE ? OR display_name ILIKE ?", escaped, escaped)
+	}
+	if q.Role != "" {
+		tx = tx.Where("role = ?", q.Role)
+	}
+	if q.Disabled != nil {
+		if *q.Disabled {
+			tx = tx.Where("disabled_at IS NOT NULL")
+		} else {
+			tx = tx.Where("disabled_at IS NULL")
+		}
+	}
+
+	if err := tx.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("count users: %w", err)
+	}
+
+	result := tx.Order("id").Offset((q.Page - 1) * q.Limit).Limit(q.Limit).Find(&users)
+	if result.Error != nil {
+		return nil, 0, fmt.Errorf("get users: %w", result.Error)
+	}
+
+	return users, total, nil
+}
+
+// * setUserDisabled disables or enables an account, disabling also logs the user out everywhere
+func setUserDisabled(db *gorm.DB, id int, disabled bool) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var disabledAt interface{}
+		if disabled {
+			disabledAt = gorm.Expr("COALESCE(disabled_at, ?)", time.Now())
+		}
+
+		result := tx.Model(&User{}).Where("id = ?", id).Update("disabled_at", disabledAt)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrUserNotFound
+		}
+
+		if !disabled {
+			return nil
+		}
+		return revokeUserSessions(tx, uint(id))
+	})
+}
+
+// * requirePasswordReset logs the user out everywhere and refuses their password until they reset it,
+// * it returns a reset token to mail them
+func requirePasswordReset(db *gorm.DB, id int) (string, *User, error) {
+	user, err := getUser(db, id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&User{}).Where("id = ?", id).Update("password_reset_required", true).Error; err != nil {
+			return err
+		}
+		return revokeUserSessions(tx, user.ID)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return createPasswordResetToken(db, user.Email)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// * baselineUser is the users table as the first version of the API created it, before roles
+type baselineUser struct {
+	gorm.Model
+	Email    string `gorm:"unique"`
+	Password string
+}
+
+func TestMigrateRolesMakesBaselineUsersEditors(t *testing.T) {
+	db := testDB(t)
+	schemaName := fmt.Sprintf("baseline_%d", time.Now().UnixNano())
+	if err := db.Exec("CREATE SCHEMA " + schemaName).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DROP SCHEMA " + schemaName + " CASCADE") })
+
+	conn, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline, err := gorm.Open(postgres.New(postgres.Config{Conn: conn}), &gorm.Config{
+		Logger:         logger.Default.LogMode(logger.Silent),
+		NamingStrategy: schema.NamingStrategy{TablePrefix: schemaName + "."},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := baseline.Table(schemaName + ".users")
+	if err := users.AutoMigrate(&baselineUser{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{"first@example.com", "second@example.com"} {
+		if err := users.Create(&baselineUser{Email: email, Password: "hash"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := migrateRoles(baseline); err != nil {
+		t.Fatalf("migrate roles: %v", err)
+	}
+	if err := baseline.AutoMigrate(&User{}); err != nil {
+		t.Fatal(err)
+	}
+	var roles []string
+	baseline.Model(&User{}).Pluck("role", &roles)
+	if len(roles) != 2 || roles[0] != RoleEditor || roles[1] != RoleEditor {
+		t.Fatalf("baseline users have roles %v, want both %s", roles, RoleEditor)
+	}
+
+	// * once the column exists, new users stay readers
+	if err := baseline.Create(&User{Email: "third@example.com", Password: "hash"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateRoles(baseline); err != nil {
+		t.Fatalf("migrate roles again: %v", err)
+	}
+	var role string
+	baseline.Model(&User{}).Where("email = ?", "third@example.com").Pluck("role", &role)
+	if role != RoleReader {
+		t.Fatalf("a user registered after the migration is %q, want %s", role, RoleReader)
+	}
+}
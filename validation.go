@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/go-playground/validator/v10"
+)
+
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+
+	// * report fields by their json name, that's what the client sent
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	v.RegisterValidation("password", validatePassword)
+	v.RegisterValidation("maxbytes", validateMaxBytes)
+
+	return v
+}
+
+// * validatePassword wants at least one lowercase letter, one uppercase letter and one digit, length is checked by min/max
+func validatePassword(fl validator.FieldLevel) bool {
+	var lower, upper, digit bool
+
+	for _, r := range fl.Field().String() {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+
+	return lower && upper && digit
+}
+
+// * validateMaxBytes is max for byte length, max counts characters and a character can take up to 4 bytes
+func validateMaxBytes(fl validator.FieldLevel) bool {
+	limit, err := strconv.Atoi(fl.Param())
+	if err != nil {
+		panic("maxbytes needs an integer parameter: " + fl.Param())
+	}
+	return len(fl.Field().String()) <= limit
+}
+
+func fieldErrorMessage(fe validator.FieldError) string {
+	field := fe.Field()
+
+	switch fe.Tag() {
+	case "required":
+		return field + " is required"
+	case "email":
+		return field + " must be a valid email address"
+	case "http_url":
+		return field + " must be an http or https URL"
+	case "bcp47_language_tag":
+		return field + " must be a BCP 47 language tag, e.g. en-US"
+	case "url":
+		return field + " must be an absolute URL"
+	case "eq":
+		return fmt.Sprintf("%s must be %s", field, fe.Param())
+	case "len":
+		return fmt.Sprintf("%s must be %s characters", field, fe.Param())
+	case "oneof":
+		return fmt.Sprintf("%s must be one of: %s", field, fe.Param())
+	case "password":
+		return field + " must contain an uppercase letter, a lowercase letter and a digit"
+	case "min":
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("%s must be at least %s characters", field, fe.Param())
+		}
+		return fmt.Sprintf("%s must be at least %s", field, fe.Param())
+	case "max":
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("%s must be at most %s characters", field, fe.Param())
+		}
+		return fmt.Sprintf("%s must be at most %s", field, fe.Param())
+	case "maxbytes":
+		return fmt.Sprintf("%s must be at most %s bytes", field, fe.Param())
+	case "gt":
+		return fmt.Sprintf("%s must be greater than %s", field, fe.Param())
+	case "gte":
+		return fmt.Sprintf("%s must be at least %s", field, fe.Param())
+	case "lte":
+		return fmt.Sprintf("%s must be at most %s", field, fe.Param())
+	default:
+		return fmt.Sprintf("%s failed the %s rule", field, fe.Tag())
+	}
+}
+
+// * validateStruct runs the validate tags on a DTO and returns a 400 problem listing every failing field
+func validateStruct(s interface{}) error {
+	err := validate.Struct(s)
+	if err == nil {
+		return nil
+	}
+
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return err
+	}
+
+	fields := make([]FieldError, 0, len(verrs))
+	for _, fe := range verrs {
+		fields = append(fields, FieldError{
+			Field:   fe.Field(),
+			Message: fieldErrorMessage(fe),
+		})
+	}
+
+	return validationProblem(fields)
+}
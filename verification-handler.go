@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+)
+
+func verificationMail(user *User) Mail {
+	to := verificationTarget(user)
+	token := newVerificationToken(user.ID, to, time.Now().Add(emailVerificationTTL))
+
+	return Mail{
+		To:      to,
+		Subject: "Verify your email",
+		Body: "Open this link to verify your email address:\n\n" +
+			publicURL + "/email/verify?token=" + url.QueryEscape(token) + "\n\n" +
+			"It expires in " + emailVerificationTTL.String() + ". If you didn't ask for this, ignore this email.",
+	}
+}
+
+// * sendVerificationMail mails a new verification link unless one went out within verificationCooldown
+func sendVerificationMail(user *User) error {
+	if err := claimVerificationSend(gormdb, user); err != nil {
+		return err
+	}
+
+	sendMail(verificationMail(user))
+	return nil
+}
+
+// * requireVerifiedEmail blocks unverified users, mount it after authRequired.
+// * The token's claim can be stale right after verifying, so a false claim is checked against the database.
+func requireVerifiedEmail(c *fiber.Ctx) error {
+	principal := currentPrincipal(c)
+	if principal != nil && principal.EmailVerified {
+		return c.Next()
+	}
+
+	user, err := getUser(gormdb, int(currentUserID(c)))
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return internalProblem("could not get user", err)
+	}
+	if user == nil || user.EmailVerifiedAt == nil {
+		return newProblem(fiber.StatusForbidden, "verify your email first, see POST /email/verify/resend")
+	}
+
+	return c.Next()
+}
+
+// * resendLimiter caps resends per client IP on top of the per-user cooldown
+var resendLimiter = limiter.New(limiter.Config{
+	Max:        5,
+	Expiration: time.Hour,
+	LimitReached: func(c *fiber.Ctx) error {
+		return newProblem(fiber.StatusTooManyRequests, "too many verification emails requested, try again later")
+	},
+})
+
+// @Summary Verify email
+// @Description Open the link from the verification email. Tokens already issued keep email_verified false
+// @Description until they are refreshed, the API checks the database in the meantime.
+// @Tags auth
+// @Produce  json
+// @Param token query string true "Token from the verification email"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} Problem "Bad Request"
+// @Failure 409 {object} Problem "Conflict"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /email/verify [get]
+func VerifyEmail(c *fiber.Ctx) error {
+	err := verifyEmail(gormdb, c.Query("token"))
+	if errors.Is(err, ErrInvalidVerificationToken) {
+		return newProblem(fiber.StatusBadRequest, err.Error())
+	}
+	if errors.Is(err, ErrEmailTaken) {
+		return newProblem(fiber.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return internalProblem("could not verify email", err)
+	}
+
+	return c.JSON(MessageResponse{
+		Message: "Email verified",
+	})
+}
+
+// @Summary Resend verification email
+// @Description Mail a new verification link to the logged in user, or to their pending email after
+// @Description PUT /me/email. One email per minute per user,
+// @Description and 5 requests per hour per client.
+// @Tags auth
+// @Produce  json
+// @Security ApiKeyAuth
+// @Success 202 {object} MessageResponse
+// @Failure 401 {object} Problem "Unauthorized"
+// @Failure 409 {object} Problem "Conflict"
+// @Failure 429 {object} Problem "Too Many Requests"
+// @Failure 500 {object} Problem "Internal Server Error"
+// @Router /email/verify/resend [post]
+func ResendVerification(c *fiber.Ctx) error {
+	user, err := getUser(gormdb, int(currentUserID(c)))
+	if errors.Is(err, ErrUserNotFound) {
+		return newProblem(fiber.StatusUnauthorized, "user no longer exists")
+	}
+	if err != nil {
+		return internalProblem("could not get user", err)
+	}
+
+	err = sendVerificationMail(user)
+	switch {
+	case errors.Is(err, ErrEmailAlreadyVerified):
+		return newProblem(fiber.StatusConflict, err.Error())
+	case errors.Is(err, ErrVerificationTooSoon):
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(verificationCooldown/time.Second)))
+		return newProblem(fiber.StatusTooManyRequests, err.Error())
+	case err != nil:
+		return internalProblem("could not send verification email", err)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(MessageResponse{
+		Message: "Verification email sent",
+	})
+}
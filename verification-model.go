@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidVerificationToken = errors.New("invalid or expired verification link")
+	ErrEmailAlreadyVerified     = errors.New("email is already verified")
+	ErrVerificationTooSoon      = errors.New("a verification email was sent recently, try again later")
+)
+
+// * verificationCooldown is the least time between two verification emails to one user
+const verificationCooldown = time.Minute
+
+// * newVerificationToken signs "<user id>:<email>:<expiry>" with HMAC-SHA256. The email is part of it,
+// * so a link stops working once the user changes their email.
+func newVerificationToken(userID uint, email string, expires time.Time) string {
+	payload := strconv.FormatUint(uint64(userID), 10) + ":" + email + ":" +
+		strconv.FormatInt(expires.Unix(), 10)
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(verificationMAC(payload))
+}
+
+func verificationMAC(payload string) []byte {
+	mac := hmac.New(sha256.New, emailVerificationSecret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// * parseVerificationToken checks the signature and expiry, it returns the user id and email the link was made for
+func parseVerificationToken(token string) (uint, string, error) {
+	encodedPayload, encodedMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return 0, "", ErrInvalidVerificationToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return 0, "", ErrInvalidVerificationToken
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil || !hmac.Equal(sum, verificationMAC(string(payload))) {
+		return 0, "", ErrInvalidVerificationToken
+	}
+
+	// * the email may contain ':' itself, so the id is cut from the front and the expiry from the back
+	idPart, rest, _ := strings.Cut(string(payload), ":")
+	sep := strings.LastIndex(rest, ":")
+	if sep < 0 {
+		return 0, "", ErrInvalidVerificationToken
+	}
+	id, err := strconv.ParseUint(idPart, 10, 32)
+	if err != nil {
+		return 0, "", ErrInvalidVerificationToken
+	}
+	expires, err := strconv.ParseInt(rest[sep+1:], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0, "", ErrInvalidVerificationToken
+	}
+
+	return uint(id), rest[:sep], nil
+}
+
+// * verificationTarget is the email a verification link goes to, a pending email change comes first
+func verificationTarget(user *User) string {
+	if user.PendingEmail != nil {
+		return *user.PendingEmail
+	}
+	return user.Email
+}
+
+// * verifyEmail marks the email of the link as verified, verifying twice is fine.
+// * A link for the pending email makes it the user's email.
+func verifyEmail(db *gorm.DB, token string) error {
+	id, email, err := parseVerificationToken(token)
+	if err != nil {
+		return err
+	}
+
+	result := db.Model(&User{}).
+		Where("id = ? AND email = ?", id, email).
+		Update("email_verified_at", gorm.Expr("COALESCE(email_verified_at, ?)", time.Now()))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+
+	result = db.Model(&User{}).
+		Where("id = ? AND pending_email = ?", id, email).
+		Updates(map[string]interface{}{
+			"email":             email,
+			"pending_email":     nil,
+			"email_verified_at": time.Now(),
+		})
+	if errors.Is(result.Error, gorm.ErrDuplicatedKey) {
+		return ErrEmailTaken // * somebody registered it since the change was requested
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidVerificationToken
+	}
+
+	return nil
+}
+
+// * claimVerificationSend records that a verification email goes out now, it fails when the last one
+// * was less than verificationCooldown ago. The conditional update makes concurrent resends send once.
+func claimVerificationSend(db *gorm.DB, user *User) error {
+	if user.EmailVerifiedAt != nil && user.PendingEmail == nil {
+		return ErrEmailAlreadyVerified
+	}
+
+	now := time.Now()
+	result := db.Model(&User{}).
+		Where("id = ? AND (verification_sent_at IS NULL OR verification_sent_at < ?)", user.ID, now.Add(-verificationCooldown)).
+		Update("verification_sent_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrVerificationTooSoon
+	}
+
+	user.VerificationSentAt = &now
+	return nil
+}
+
+// * verifyExistingUsers marks everybody who registered before verification existed as verified,
+// * main only calls it in the run that adds the column
+func verifyExistingUsers(db *gorm.DB) error {
+	return db.Model(&User{}).
+		Where("email_verified_at IS NULL").
+		Update("email_verified_at", gorm.Expr("created_at")).Error
+}